@@ -32,4 +32,5 @@ type CollectionProvider interface {
 		opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
 	DeleteMany(ctx context.Context, filter interface{},
 		opts ...*options.DeleteOptions) (*mongo.DeleteResult, error)
+	Indexes() mongo.IndexView
 }
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	LeaseCollection    = "lease"
+	InstanceCollection = "instance"
+)
+
+type (
+	// Lease is a lock on a resource, e.g. a subscription, held by one instance until it expires.
+	// The owner keeps the lease by renewing it before it expires.
+	Lease struct {
+		Key        string    `bson:"_id"`
+		Owner      string    `bson:"owner"`
+		AcquiredAt time.Time `bson:"acquired_at"`
+		ExpiresAt  time.Time `bson:"expires_at"`
+	}
+
+	// Instance is a running instance of the service, kept alive by its heartbeats.
+	Instance struct {
+		ID        string    `bson:"_id"`
+		StartedAt time.Time `bson:"started_at"`
+		ExpiresAt time.Time `bson:"expires_at"`
+	}
+
+	// LeaseManager acquires, renews and releases the leases of an instance. Expired leases and
+	// instances are removed by a TTL index, but are ignored as soon as they expire.
+	LeaseManager struct {
+		instanceID string
+		ttl        time.Duration
+		leases     CollectionProvider
+		instances  CollectionProvider
+	}
+)
+
+func NewLeaseManager(provider DBProvider, instanceID string, ttl time.Duration) *LeaseManager {
+	return &LeaseManager{
+		instanceID: instanceID,
+		ttl:        ttl,
+		leases:     provider.Collection(LeaseCollection),
+		instances:  provider.Collection(InstanceCollection),
+	}
+}
+
+func (m *LeaseManager) InstanceID() string {
+	return m.instanceID
+}
+
+func (m *LeaseManager) TTL() time.Duration {
+	return m.ttl
+}
+
+// CreateIndexes creates the TTL indexes of the lease and instance collections.
+func (m *LeaseManager) CreateIndexes(ctx context.Context) error {
+	ttlIndex := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+
+	if _, err := m.leases.Indexes().CreateOne(ctx, ttlIndex); err != nil {
+		return err
+	}
+
+	_, err := m.instances.Indexes().CreateOne(ctx, ttlIndex)
+	return err
+}
+
+// Acquire takes the lease of the key unless another instance holds it and it has not expired.
+// It reports whether the instance holds the lease.
+func (m *LeaseManager) Acquire(ctx context.Context, key string) (bool, error) {
+	now := time.Now()
+	filter := bson.M{
+		"_id": key,
+		"$or": bson.A{
+			bson.M{"owner": m.instanceID},
+			bson.M{"expires_at": bson.M{"$lte": now}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"owner":       m.instanceID,
+			"acquired_at": now,
+			"expires_at":  now.Add(m.ttl),
+		},
+	}
+
+	// the upsert fails with a duplicate key when the lease is held by another instance
+	_, err := m.leases.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Renew extends the lease of the key. It reports false when the lease has been taken by another instance.
+func (m *LeaseManager) Renew(ctx context.Context, key string) (bool, error) {
+	res, err := m.leases.UpdateOne(ctx,
+		bson.M{"_id": key, "owner": m.instanceID},
+		bson.M{"$set": bson.M{"expires_at": time.Now().Add(m.ttl)}})
+	if err != nil {
+		return false, err
+	}
+
+	return res.MatchedCount == 1, nil
+}
+
+// Held reports whether the instance holds the lease of the key and it has not expired.
+func (m *LeaseManager) Held(ctx context.Context, key string) (bool, error) {
+	err := m.leases.FindOne(ctx, bson.M{
+		"_id":        key,
+		"owner":      m.instanceID,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}).Err()
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Release gives up the lease of the key if the instance holds it.
+func (m *LeaseManager) Release(ctx context.Context, key string) error {
+	_, err := m.leases.DeleteMany(ctx, bson.M{"_id": key, "owner": m.instanceID})
+	return err
+}
+
+// Heartbeat marks the instance as alive until the TTL has passed.
+func (m *LeaseManager) Heartbeat(ctx context.Context) error {
+	now := time.Now()
+	_, err := m.instances.UpdateOne(ctx,
+		bson.M{"_id": m.instanceID},
+		bson.M{
+			"$set":         bson.M{"expires_at": now.Add(m.ttl)},
+			"$setOnInsert": bson.M{"started_at": now},
+		},
+		options.Update().SetUpsert(true))
+	return err
+}
+
+// Instances returns the IDs of the instances that are alive, sorted.
+func (m *LeaseManager) Instances(ctx context.Context) ([]string, error) {
+	cursor, err := m.instances.Find(ctx,
+		bson.M{"expires_at": bson.M{"$gt": time.Now()}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []Instance{}
+	if err := cursor.All(ctx, &instances); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(instances))
+	for _, instance := range instances {
+		ids = append(ids, instance.ID)
+	}
+
+	return ids, nil
+}
+
+// Leave releases all leases of the instance and removes it from the instances,
+// so that other instances take over without waiting for the leases to expire.
+func (m *LeaseManager) Leave(ctx context.Context) error {
+	if _, err := m.leases.DeleteMany(ctx, bson.M{"owner": m.instanceID}); err != nil {
+		return err
+	}
+
+	_, err := m.instances.DeleteMany(ctx, bson.M{"_id": m.instanceID})
+	return err
+}
@@ -0,0 +1,313 @@
+package cli
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/salesforce"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+
+	"go.uber.org/zap"
+)
+
+const usage = `usage:
+  deadletters list [-client-id <client ID>]
+  deadletters retry [-client-id <client ID>] <id>
+  deadletters discard [-client-id <client ID>] <id>
+  replays list [-client-id <client ID>]
+  replays show [-client-id <client ID>] <id>
+  replays start -client-id <client ID> -sinks <names> [-topics <names>] [-from <time>] [-to <time>]
+                [-from-replay-id <hex>] [-to-replay-id <hex>] [-rate <events per second>]
+  replays cancel [-client-id <client ID>] <id>
+  replays resume [-client-id <client ID>] <id>`
+
+// how often the progress of a replay job started from the command line is printed
+const replayPollInterval = time.Second
+
+type Handler interface {
+	Run(ctx context.Context, args []string) error
+}
+
+type handler struct {
+	logger     *zap.Logger
+	salesforce salesforce.Salesforce
+	out        io.Writer
+}
+
+// NewHandler returns the handler of the commands run from the command line, e.g. to inspect, retry
+// or discard dead-lettered events or to replay stored events. The output is written to out.
+func NewHandler(
+	logger *zap.Logger,
+	salesforce salesforce.Salesforce,
+	out io.Writer) Handler {
+	return &handler{
+		logger:     logger,
+		salesforce: salesforce,
+		out:        out,
+	}
+}
+
+func (h *handler) Run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command\n%s", usage)
+	}
+
+	switch args[0] {
+	case "deadletters":
+		return h.deadLetters(ctx, args[1:])
+	case "replays":
+		return h.replays(ctx, args[1:])
+	}
+
+	return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+}
+
+func (h *handler) deadLetters(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing deadletters command\n%s", usage)
+	}
+
+	flags := flag.NewFlagSet("deadletters "+args[0], flag.ContinueOnError)
+	flags.SetOutput(h.out)
+	clientID := flags.String("client-id", "", "only the dead letters of the account, all accounts by default")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return h.listDeadLetters(ctx, *clientID)
+	case "retry":
+		id, err := deadLetterID(flags)
+		if err != nil {
+			return err
+		}
+
+		if err := h.salesforce.RetryDeadLetter(ctx, *clientID, id); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h.out, "dead letter %s retried\n", id)
+		return nil
+	case "discard":
+		id, err := deadLetterID(flags)
+		if err != nil {
+			return err
+		}
+
+		if err := h.salesforce.DiscardDeadLetter(ctx, *clientID, id); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h.out, "dead letter %s discarded\n", id)
+		return nil
+	}
+
+	return fmt.Errorf("unknown deadletters command %q\n%s", args[0], usage)
+}
+
+func (h *handler) listDeadLetters(ctx context.Context, clientID string) error {
+	letters, err := h.salesforce.ListDeadLetters(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(h.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tORG ID\tTOPIC\tATTEMPTS\tCREATED AT\tERROR")
+	for _, letter := range letters {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+			letter.ID,
+			letter.OrgID,
+			letter.TopicName,
+			letter.Attempts,
+			letter.CreatedAt.Format(time.RFC3339),
+			letter.Error)
+	}
+
+	return w.Flush()
+}
+
+func deadLetterID(flags *flag.FlagSet) (string, error) {
+	if flags.NArg() != 1 {
+		return "", fmt.Errorf("missing dead letter id\n%s", usage)
+	}
+
+	return flags.Arg(0), nil
+}
+
+func (h *handler) replays(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing replays command\n%s", usage)
+	}
+
+	flags := flag.NewFlagSet("replays "+args[0], flag.ContinueOnError)
+	flags.SetOutput(h.out)
+	clientID := flags.String("client-id", "", "only the replay jobs of the account, all accounts by default")
+	topics := flags.String("topics", "", "API names or topic names separated by commas, all topics by default")
+	sinks := flags.String("sinks", "", "names of the handlers the events are dispatched to separated by commas, webhook or mirror")
+	from := flags.String("from", "", "RFC 3339 time of the first event")
+	to := flags.String("to", "", "RFC 3339 time of the last event")
+	fromReplayID := flags.String("from-replay-id", "", "hex encoded replay ID of the first event of the topic")
+	toReplayID := flags.String("to-replay-id", "", "hex encoded replay ID of the last event of the topic")
+	rate := flags.Int("rate", 0, "maximum number of events dispatched per second")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		return h.listReplayJobs(ctx, *clientID)
+	case "show":
+		id, err := replayJobID(flags)
+		if err != nil {
+			return err
+		}
+
+		job, err := h.salesforce.GetReplayJob(ctx, *clientID, id)
+		if err != nil {
+			return err
+		}
+
+		return h.printReplayJobs([]salesforce.ReplayJob{job})
+	case "start":
+		if *clientID == "" {
+			return fmt.Errorf("missing client id\n%s", usage)
+		}
+
+		req := salesforce.ReplayRequest{
+			Topics:       splitList(*topics),
+			Sinks:        splitList(*sinks),
+			FromReplayID: *fromReplayID,
+			ToReplayID:   *toReplayID,
+			Rate:         *rate,
+		}
+
+		var err error
+		if req.From, err = parseTime(*from); err != nil {
+			return fmt.Errorf("invalid -from: %w", err)
+		}
+		if req.To, err = parseTime(*to); err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+
+		job, err := h.salesforce.StartReplay(ctx, *clientID, req)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h.out, "replay job %s started\n", job.ID)
+		return h.waitReplayJob(ctx, *clientID, job.ID)
+	case "cancel":
+		id, err := replayJobID(flags)
+		if err != nil {
+			return err
+		}
+
+		if err := h.salesforce.CancelReplayJob(ctx, *clientID, id); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h.out, "replay job %s canceled\n", id)
+		return nil
+	case "resume":
+		id, err := replayJobID(flags)
+		if err != nil {
+			return err
+		}
+
+		if err := h.salesforce.ResumeReplayJob(ctx, *clientID, id); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(h.out, "replay job %s resumed\n", id)
+		return h.waitReplayJob(ctx, *clientID, id)
+	}
+
+	return fmt.Errorf("unknown replays command %q\n%s", args[0], usage)
+}
+
+// waitReplayJob prints the progress of the replay job until it has stopped. When ctx is done first,
+// the job is interrupted and continued by the service once it is running again.
+func (h *handler) waitReplayJob(ctx context.Context, clientID, id string) error {
+	ticker := time.NewTicker(replayPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Fprintf(h.out, "replay job %s interrupted, it is continued by the service\n", id)
+			return nil
+		case <-ticker.C:
+		}
+
+		job, err := h.salesforce.GetReplayJob(ctx, clientID, id)
+		if err != nil {
+			return err
+		}
+
+		switch job.Status {
+		case models.ReplayJobStatusCompleted, models.ReplayJobStatusCanceled:
+			fmt.Fprintf(h.out, "replay job %s %s, %d events replayed\n", id, strings.ToLower(string(job.Status)), job.Replayed)
+			return nil
+		case models.ReplayJobStatusFailed:
+			return fmt.Errorf("replay job %s failed after %d events: %s", id, job.Replayed, job.Error)
+		}
+
+		fmt.Fprintf(h.out, "%d events replayed\n", job.Replayed)
+	}
+}
+
+func (h *handler) listReplayJobs(ctx context.Context, clientID string) error {
+	jobs, err := h.salesforce.ListReplayJobs(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	return h.printReplayJobs(jobs)
+}
+
+func (h *handler) printReplayJobs(jobs []salesforce.ReplayJob) error {
+	w := tabwriter.NewWriter(h.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tORG ID\tTOPICS\tSINKS\tSTATUS\tREPLAYED\tCREATED AT\tERROR")
+	for _, job := range jobs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			job.ID,
+			job.OrgID,
+			strings.Join(job.TopicNames, ","),
+			strings.Join(job.Sinks, ","),
+			job.Status,
+			job.Replayed,
+			job.CreatedAt.Format(time.RFC3339),
+			job.Error)
+	}
+
+	return w.Flush()
+}
+
+func replayJobID(flags *flag.FlagSet) (string, error) {
+	if flags.NArg() != 1 {
+		return "", fmt.Errorf("missing replay job id\n%s", usage)
+	}
+
+	return flags.Arg(0), nil
+}
+
+func splitList(value string) []string {
+	return strings.FieldsFunc(value, func(c rune) bool {
+		return c == ',' || unicode.IsSpace(c)
+	})
+}
+
+// parseTime parses an RFC 3339 time, an empty value is the zero time.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
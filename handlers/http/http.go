@@ -1,8 +1,14 @@
 package http
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github/michaellimmm/salesforce-app-example/models"
 	"github/michaellimmm/salesforce-app-example/pkg/salesforce"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/gofiber/fiber/v2/middleware/session"
 
@@ -12,6 +18,7 @@ import (
 
 type Handler interface {
 	Serve(string) error
+	Shutdown(ctx context.Context) error
 }
 
 type handler struct {
@@ -19,6 +26,9 @@ type handler struct {
 	logger       *zap.Logger
 	salesforce   salesforce.Salesforce
 	sessionStore *session.Store
+	// canceled on shutdown to end the event streams
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewHandler(
@@ -28,14 +38,25 @@ func NewHandler(
 	// initiate session
 	sessionStore := session.New()
 
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &handler{
 		app:          httpServer,
 		logger:       logger,
 		salesforce:   salesforce,
 		sessionStore: sessionStore,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
+// Shutdown ends the event streams and stops accepting requests,
+// waiting for the requests in progress until ctx is done.
+func (h *handler) Shutdown(ctx context.Context) error {
+	h.cancel()
+	return h.app.ShutdownWithContext(ctx)
+}
+
 func (h *handler) Serve(addr string) error {
 	h.app.Get("/", func(c *fiber.Ctx) error {
 		return c.Render("home/index", fiber.Map{})
@@ -120,9 +141,37 @@ func (h *handler) Serve(addr string) error {
 			return c.Redirect("/linkage/")
 		}
 
+		subscribedObjects, err := h.salesforce.GetSubscribedObjects(c.Context(), fmt.Sprintf("%s", clientID))
+		if err != nil {
+			h.logger.Error("failed to get subscribed objects", zap.Error(err))
+			return c.Redirect("/linkage/")
+		}
+
+		objects, err := h.salesforce.ListSubscribableObjects(c.Context(), fmt.Sprintf("%s", clientID))
+		if err != nil {
+			h.logger.Warn("failed to discover objects, using standard objects", zap.Error(err))
+			objects = salesforce.StandardObjectList
+		}
+
+		listed := make(map[string]bool, len(objects))
+		for _, object := range objects {
+			listed[object.Name] = true
+		}
+
+		selected := make(map[string]bool, len(subscribedObjects))
+		customTopics := []string{}
+		for _, object := range subscribedObjects {
+			selected[object.Name] = true
+			if !listed[object.Name] {
+				customTopics = append(customTopics, object.Name)
+			}
+		}
+
 		c.Response().Header.Add("HX-Redirect", "/cdc/")
 		return c.Render("registercdc/index", fiber.Map{
-			"object": salesforce.StandardObjectList,
+			"object":       objects,
+			"selected":     selected,
+			"customTopics": strings.Join(customTopics, "\n"),
 		})
 	})
 
@@ -142,20 +191,296 @@ func (h *handler) Serve(addr string) error {
 			return c.Redirect("/linkage/")
 		}
 
-		err = h.salesforce.SaveStandardObjects(
+		results, err := h.salesforce.SaveStandardObjects(
 			c.Context(),
 			fmt.Sprintf("%s", clientID),
-			request.StandardObjects)
+			request.SubscribedObjects())
+		if err != nil {
+			return c.Render("registercdc/_failed", fiber.Map{"errorMessage": err, "results": results})
+		}
+
+		return c.Render("registercdc/_success", fiber.Map{"results": results})
+	})
+
+	h.app.Get("/webhook/", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return c.Redirect("/linkage/")
+		}
+
+		webhook, _, err := h.salesforce.GetWebhook(c.Context(), clientID)
+		if err != nil {
+			h.logger.Error("failed to get webhook", zap.Error(err))
+			return c.Redirect("/linkage/")
+		}
+
+		deliveries, err := h.salesforce.ListWebhookDeliveries(c.Context(), clientID)
+		if err != nil {
+			h.logger.Error("failed to list webhook deliveries", zap.Error(err))
+		}
+
+		c.Response().Header.Add("HX-Redirect", "/webhook/")
+		return c.Render("webhook/index", fiber.Map{
+			"webhook":    webhook,
+			"topics":     strings.Join(webhook.Topics, "\n"),
+			"deliveries": deliveries,
+		})
+	})
+
+	h.app.Post("/webhook/", func(c *fiber.Ctx) error {
+		request := new(WebhookRequest)
+		_ = c.BodyParser(request)
+
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return c.Redirect("/linkage/")
+		}
+
+		if err := h.salesforce.SaveWebhook(c.Context(), clientID, request.WebhookRequest()); err != nil {
+			h.logger.Error("failed to save webhook", zap.Error(err))
+			return c.Render("webhook/_failed", fiber.Map{"errorMessage": err})
+		}
+
+		return c.Render("webhook/_success", fiber.Map{"removed": request.URL == ""})
+	})
+
+	h.app.Get("/events/", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return c.Redirect("/linkage/")
+		}
+
+		subscribedObjects, err := h.salesforce.GetSubscribedObjects(c.Context(), clientID)
+		if err != nil {
+			h.logger.Error("failed to get subscribed objects", zap.Error(err))
+			return c.Redirect("/linkage/")
+		}
+
+		c.Response().Header.Add("HX-Redirect", "/events/")
+		return c.Render("events/index", fiber.Map{
+			"object": subscribedObjects,
+		})
+	})
+
+	h.app.Get("/events/feed", func(c *fiber.Ctx) error {
+		return c.Render("events/_feed", fiber.Map{
+			"topic": c.Query("topic"),
+		})
+	})
+
+	h.app.Get("/events/stream", h.streamEvents)
+
+	h.app.Get("/subscriptions/", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(h.salesforce.ListSubscriptions(clientID))
+	})
+
+	h.app.Post("/subscriptions/:action", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return err
+		}
+
+		request := new(SubscriptionRequest)
+		if err := c.BodyParser(request); err != nil || request.Topic == "" {
+			return fiber.NewError(fiber.StatusBadRequest, "'topic' cannot be empty")
+		}
+
+		switch c.Params("action") {
+		case "start":
+			err = h.salesforce.StartSubscription(c.Context(), clientID, request.Topic)
+		case "stop":
+			err = h.salesforce.StopSubscription(c.Context(), clientID, request.Topic)
+		case "restart":
+			err = h.salesforce.RestartSubscription(c.Context(), clientID, request.Topic)
+		default:
+			return fiber.ErrNotFound
+		}
+		if err != nil {
+			h.logger.Error("failed to change subscription", zap.Error(err))
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(h.salesforce.ListSubscriptions(clientID))
+	})
+
+	h.app.Get("/deadletters/", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return err
+		}
+
+		letters, err := h.salesforce.ListDeadLetters(c.Context(), clientID)
+		if err != nil {
+			h.logger.Error("failed to list dead letters", zap.Error(err))
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(letters)
+	})
+
+	h.app.Post("/deadletters/:id/:action", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return err
+		}
+
+		switch c.Params("action") {
+		case "retry":
+			err = h.salesforce.RetryDeadLetter(c.Context(), clientID, c.Params("id"))
+		case "discard":
+			err = h.salesforce.DiscardDeadLetter(c.Context(), clientID, c.Params("id"))
+		default:
+			return fiber.ErrNotFound
+		}
+		if errors.Is(err, salesforce.ErrDeadLetterNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			h.logger.Error("failed to process dead letter", zap.Error(err))
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	h.app.Get("/replays/", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return err
+		}
+
+		jobs, err := h.salesforce.ListReplayJobs(c.Context(), clientID)
 		if err != nil {
-			return c.Render("registercdc/_failed", fiber.Map{"errorMessage": err})
+			h.logger.Error("failed to list replay jobs", zap.Error(err))
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 		}
 
-		return c.Render("registercdc/_success", fiber.Map{})
+		return c.JSON(jobs)
+	})
+
+	h.app.Post("/replays/", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return err
+		}
+
+		request := new(ReplayRequest)
+		if err := c.BodyParser(request); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		req, err := request.ReplayRequest()
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		job, err := h.salesforce.StartReplay(c.Context(), clientID, req)
+		if errors.Is(err, salesforce.ErrInvalidReplayRequest) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			h.logger.Error("failed to start replay", zap.Error(err))
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		return c.Status(fiber.StatusAccepted).JSON(job)
+	})
+
+	h.app.Get("/replays/:id", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return err
+		}
+
+		job, err := h.salesforce.GetReplayJob(c.Context(), clientID, c.Params("id"))
+		if errors.Is(err, salesforce.ErrReplayJobNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			h.logger.Error("failed to get replay job", zap.Error(err))
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(job)
+	})
+
+	h.app.Post("/replays/:id/:action", func(c *fiber.Ctx) error {
+		clientID, err := h.getSessionClientID(c)
+		if err != nil {
+			return err
+		}
+
+		switch c.Params("action") {
+		case "cancel":
+			err = h.salesforce.CancelReplayJob(c.Context(), clientID, c.Params("id"))
+		case "resume":
+			err = h.salesforce.ResumeReplayJob(c.Context(), clientID, c.Params("id"))
+		default:
+			return fiber.ErrNotFound
+		}
+		switch {
+		case errors.Is(err, salesforce.ErrReplayJobNotFound):
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		case errors.Is(err, salesforce.ErrReplayJobStatus):
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		case err != nil:
+			h.logger.Error("failed to change replay job", zap.Error(err))
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	h.app.Post("/linkage/unlink", func(c *fiber.Ctx) error {
+		sess, err := h.sessionStore.Get(c)
+		if err != nil {
+			h.logger.Error("failed to get session", zap.Error(err))
+			return c.Redirect("/linkage/")
+		}
+
+		clientID := sess.Get("clientID")
+		if clientID == "" || clientID == nil {
+			return c.Redirect("/linkage/")
+		}
+
+		if err := h.salesforce.UnlinkAccount(c.Context(), fmt.Sprintf("%s", clientID)); err != nil {
+			h.logger.Error("failed to unlink account", zap.Error(err))
+			return c.Render("linkage/failed", fiber.Map{"errorMessage": err.Error()})
+		}
+
+		sess.Delete("clientID")
+		if err := sess.Save(); err != nil {
+			h.logger.Error("failed to save session", zap.Error(err))
+		}
+
+		return c.Redirect("/")
 	})
 
 	return h.app.Listen(addr)
 }
 
+// getSessionClientID returns the client ID of the linked account of the session,
+// or an unauthorized error when there is none.
+func (h *handler) getSessionClientID(c *fiber.Ctx) (string, error) {
+	sess, err := h.sessionStore.Get(c)
+	if err != nil {
+		h.logger.Error("failed to get session", zap.Error(err))
+		return "", fiber.ErrUnauthorized
+	}
+
+	clientID := sess.Get("clientID")
+	if clientID == "" || clientID == nil {
+		return "", fiber.ErrUnauthorized
+	}
+
+	return fmt.Sprintf("%s", clientID), nil
+}
+
 type OauthResponse struct {
 	RedirectUrl string `json:"redirect_url"`
 }
@@ -179,4 +504,94 @@ func (o *GetLoginUrlRequest) Validate() error {
 
 type CDCRequest struct {
 	StandardObjects []string `json:"standard_objects" form:"standardObjects"`
+	// custom objects, platform events and channels separated by commas or new lines
+	CustomTopics string `json:"custom_topics" form:"customTopics"`
+	ReplayPolicy string `json:"replay_policy" form:"replayPolicy"`
+}
+
+func (r *CDCRequest) SubscribedObjects() models.SubscribedObjects {
+	names := r.StandardObjects
+	names = append(names, strings.FieldsFunc(r.CustomTopics, func(c rune) bool {
+		return c == ',' || unicode.IsSpace(c)
+	})...)
+
+	objects := make(models.SubscribedObjects, 0, len(names))
+	for _, name := range names {
+		objects = append(objects, models.SubscribedObject{
+			Name:         name,
+			ReplayPolicy: r.ReplayPolicy,
+		})
+	}
+
+	return objects
+}
+
+type WebhookRequest struct {
+	URL    string `json:"url" form:"url"`
+	Secret string `json:"secret" form:"secret"`
+	// API names separated by commas or new lines
+	Topics string `json:"topics" form:"topics"`
+}
+
+func (r *WebhookRequest) WebhookRequest() salesforce.WebhookRequest {
+	return salesforce.WebhookRequest{
+		URL:    strings.TrimSpace(r.URL),
+		Secret: r.Secret,
+		Topics: strings.FieldsFunc(r.Topics, func(c rune) bool {
+			return c == ',' || unicode.IsSpace(c)
+		}),
+	}
+}
+
+type SubscriptionRequest struct {
+	Topic string `json:"topic" form:"topic"`
+}
+
+type ReplayRequest struct {
+	// API names or topic names separated by commas or new lines, all topics when empty
+	Topics string `json:"topics" form:"topics"`
+	// names of the registered handlers separated by commas, e.g. webhook
+	Sinks string `json:"sinks" form:"sinks"`
+	// RFC 3339 times
+	From         string `json:"from" form:"from"`
+	To           string `json:"to" form:"to"`
+	FromReplayID string `json:"from_replay_id" form:"fromReplayId"`
+	ToReplayID   string `json:"to_replay_id" form:"toReplayId"`
+	Rate         int    `json:"rate" form:"rate"`
+}
+
+func (r *ReplayRequest) ReplayRequest() (salesforce.ReplayRequest, error) {
+	from, err := parseTime(r.From)
+	if err != nil {
+		return salesforce.ReplayRequest{}, fmt.Errorf("'from' is not an RFC 3339 time: %w", err)
+	}
+
+	to, err := parseTime(r.To)
+	if err != nil {
+		return salesforce.ReplayRequest{}, fmt.Errorf("'to' is not an RFC 3339 time: %w", err)
+	}
+
+	split := func(c rune) bool {
+		return c == ',' || unicode.IsSpace(c)
+	}
+
+	return salesforce.ReplayRequest{
+		Topics:       strings.FieldsFunc(r.Topics, split),
+		Sinks:        strings.FieldsFunc(r.Sinks, split),
+		From:         from,
+		To:           to,
+		FromReplayID: strings.TrimSpace(r.FromReplayID),
+		ToReplayID:   strings.TrimSpace(r.ToReplayID),
+		Rate:         r.Rate,
+	}, nil
+}
+
+// parseTime parses an RFC 3339 time, an empty value is the zero time.
+func parseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
 }
@@ -0,0 +1,124 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"html"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// a comment is sent this often so that idle streams are not closed by proxies
+const sseKeepAliveInterval = 15 * time.Second
+
+// streamEvents streams the events of the account of the session as Server-Sent Events, of the topic
+// given by the "topic" query parameter or of all topics. Every event is sent as an "event" message
+// rendered as HTML for htmx, and a "dropped" message is sent when the stream doesn't keep up.
+// The stream of events is canceled when the response is finished, e.g. when the client disconnects.
+func (h *handler) streamEvents(c *fiber.Ctx) error {
+	clientID, err := h.getSessionClientID(c)
+	if err != nil {
+		return fiber.ErrUnauthorized
+	}
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	events, err := h.salesforce.StreamEvents(ctx, clientID, c.Query("topic"))
+	if err != nil {
+		cancel()
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer cancel()
+
+		w := bufio.NewWriter(pw)
+		writeEvents(ctx, w, events)
+		pw.Close()
+	}()
+
+	// the body is closed by the server once the response is finished or discarded
+	c.Context().SetBodyStream(&sseBody{PipeReader: pr, cancel: cancel}, -1)
+	return nil
+}
+
+// sseBody is the body of an event stream, closing it cancels the stream.
+type sseBody struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (b *sseBody) Close() error {
+	b.cancel()
+	return b.PipeReader.Close()
+}
+
+// writeEvents writes the events as messages until the channel is closed or the body is closed.
+func writeEvents(ctx context.Context, w *bufio.Writer, events <-chan pubsubclient.Event) {
+	ticker := time.NewTicker(sseKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				if ctx.Err() == nil {
+					writeSSE(w, "dropped", `<div class="alert alert-warning">`+
+						`The stream was dropped because events were not received fast enough, some events were skipped.</div>`)
+					_ = w.Flush()
+				}
+				return
+			}
+
+			writeSSE(w, "event", renderEvent(event))
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+
+		// fails once the body has been closed
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeSSE writes a message, with every line of the data in its own data field.
+func writeSSE(w *bufio.Writer, event, data string) {
+	fmt.Fprintf(w, "event: %s\n", event)
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(w, "data: %s\n", line)
+	}
+	fmt.Fprint(w, "\n")
+}
+
+func renderEvent(event pubsubclient.Event) string {
+	body, err := json.MarshalIndent(map[string]interface{}{
+		"topic_name":     event.TopicName,
+		"replay_id":      hex.EncodeToString(event.ReplayID),
+		"schema_id":      event.SchemaID,
+		"changed_fields": event.ChangedFields,
+		"nulled_fields":  event.NulledFields,
+		"diff_fields":    event.DiffFields,
+		"payload":        event.Body,
+	}, "", "  ")
+	if err != nil {
+		body = []byte(err.Error())
+	}
+
+	return fmt.Sprintf(`<div class="mb-2"><span class="fw-bold">%s</span> %s<pre class="border rounded p-2 small">%s</pre></div>`,
+		html.EscapeString(time.Now().Format(time.TimeOnly)),
+		html.EscapeString(event.TopicName),
+		html.EscapeString(string(body)))
+}
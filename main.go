@@ -2,13 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"fmt"
 	"github/michaellimmm/salesforce-app-example/db"
+	"github/michaellimmm/salesforce-app-example/handlers/cli"
 	"github/michaellimmm/salesforce-app-example/handlers/http"
+	"github/michaellimmm/salesforce-app-example/models"
 	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
 	"github/michaellimmm/salesforce-app-example/pkg/restclient"
 	"github/michaellimmm/salesforce-app-example/pkg/salesforce"
+	"github/michaellimmm/salesforce-app-example/util/crypto"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	gojson "github.com/goccy/go-json"
@@ -16,10 +24,19 @@ import (
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/favicon"
 	"github.com/gofiber/template/html/v2"
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
 )
 
+const (
+	// how long a subscription stays owned by an instance that stopped renewing its lease
+	leaseTTL = 30 * time.Second
+	// how long the HTTP requests and the events being handled are waited for on shutdown
+	shutdownTimeout   = 30 * time.Second
+	disconnectTimeout = 5 * time.Second
+)
+
 func main() {
 	err := godotenv.Load()
 	if err != nil {
@@ -54,20 +71,174 @@ func main() {
 
 	db.Datastore = db.NewDB(context.Background(), db.WithURI("mongodb://localhost:27017"))
 	db.Datastore.SelectDB("salesforce_app_db")
+	if err := models.CreateIndexes(context.Background()); err != nil {
+		logger.Fatal("failed to create indexes", zap.Error(err))
+	}
+
+	// the service runs a command, e.g. "deadletters list", instead of serving when one is given
+	command := os.Args[1:]
+
+	secretKey, err := webhookSecretKey()
+	if err != nil {
+		logger.Fatal("invalid WEBHOOK_SECRET_KEY", zap.Error(err))
+	}
+	if secretKey == nil {
+		logger.Warn("WEBHOOK_SECRET_KEY is not set, webhook secrets are stored unencrypted")
+	}
+
+	opts := []salesforce.Option{salesforce.WithWebhookSecretKey(secretKey)}
+	if len(command) == 0 {
+		leases := db.NewLeaseManager(db.Datastore, instanceID(), leaseTTL)
+		if err := leases.CreateIndexes(context.Background()); err != nil {
+			logger.Fatal("failed to create lease indexes", zap.Error(err))
+		}
+		opts = append(opts, salesforce.WithLeases(leases))
+	}
 
 	restyClient := resty.New()
 	restClient := restclient.NewRestClient(logger, restyClient)
-	pubsubclient := pubsubclient.NewPubSubClient(logger)
-	salesforceService := salesforce.NewSalesForce(logger, restClient, pubsubclient)
+	pubsubclient := pubsubclient.NewPubSubClient(logger,
+		pubsubclient.WithSchemaRegistry(salesforce.NewSchemaRegistry(logger)))
+	if err := pubsubclient.WarmSchemaCache(context.Background()); err != nil {
+		logger.Error("failed to warm schema cache", zap.Error(err))
+	}
+	salesforceService := salesforce.NewSalesForce(logger, restClient, pubsubclient, opts...)
+	salesforceService.RegisterHandler(salesforce.EventStoreHandlerName, "", "", salesforce.NewEventStore(logger))
+	webhookSink := salesforce.NewWebhookSink(logger, resty.New(), secretKey)
+	salesforceService.RegisterHandler(salesforce.WebhookHandlerName, "", "", webhookSink)
+	salesforceService.RegisterHandler(salesforce.MirrorHandlerName, "", "", salesforce.NewRecordMirror(logger))
+
+	if len(command) > 0 {
+		if err := runCommand(logger, salesforceService, pubsubclient, command); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
 	logger.Info("service is running ...")
 
-	// salesforceService.SubscribeAllLinkedToken(context.Background())
+	// the events queued for the webhooks, also by the commands, are only posted while serving
+	webhookSink.Start()
+
+	if err := salesforceService.SubscribeAllLinkedToken(context.Background()); err != nil {
+		logger.Error("failed to subscribe linked accounts", zap.Error(err))
+	}
+
+	if err := salesforceService.ResumeReplayJobs(context.Background()); err != nil {
+		logger.Error("failed to resume replay jobs", zap.Error(err))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	handler := http.NewHandler(httpSrv, logger, salesforceService)
-	err = handler.Serve(httpSrvPort)
-	if err != nil {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- handler.Serve(httpSrvPort)
+	}()
+
+	select {
+	case <-ctx.Done():
+		logger.Info("shutting down ...")
+	case err := <-serveErr:
 		logger.Error("failed run handler", zap.Error(err))
-		return
 	}
+
+	shutdown(logger, handler, salesforceService, webhookSink, pubsubclient)
+}
+
+// runCommand runs the command line command, stops the replay jobs it started once their progress is saved
+// and closes the gRPC and MongoDB connections.
+func runCommand(
+	logger *zap.Logger,
+	salesforceService salesforce.Salesforce,
+	pubsubClient *pubsubclient.PubSubClient,
+	args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := salesforceService.Shutdown(shutdownCtx); err != nil {
+			logger.Error("failed to shutdown", zap.Error(err))
+		}
+
+		pubsubClient.Close()
+
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+		defer cancel()
+		if err := db.Datastore.Disconnect(disconnectCtx); err != nil {
+			logger.Error("failed to disconnect mongodb", zap.Error(err))
+		}
+	}()
+
+	return cli.NewHandler(logger, salesforceService, os.Stdout).Run(ctx, args)
+}
+
+// shutdown stops accepting HTTP requests, stops the subscriptions once the events already received
+// are handled and checkpointed, stops posting to the webhooks once the events being posted are delivered,
+// and then closes the gRPC and MongoDB connections.
+func shutdown(
+	logger *zap.Logger,
+	handler http.Handler,
+	salesforceService salesforce.Salesforce,
+	webhookSink *salesforce.WebhookSink,
+	pubsubClient *pubsubclient.PubSubClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := handler.Shutdown(ctx); err != nil {
+		logger.Error("failed to shutdown http server", zap.Error(err))
+	}
+
+	if err := salesforceService.Shutdown(ctx); err != nil {
+		logger.Error("failed to shutdown subscriptions", zap.Error(err))
+	}
+
+	if err := webhookSink.Shutdown(ctx); err != nil {
+		logger.Error("failed to shutdown webhook delivery", zap.Error(err))
+	}
+
+	pubsubClient.Close()
+
+	// the connection is closed even if the deadline has passed
+	disconnectCtx, disconnectCancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer disconnectCancel()
+	if err := db.Datastore.Disconnect(disconnectCtx); err != nil {
+		logger.Error("failed to disconnect mongodb", zap.Error(err))
+	}
+
+	logger.Info("service stopped")
+}
+
+// instanceID returns the INSTANCE_ID environment variable or, when it is not set,
+// a unique ID prefixed with the host name.
+func instanceID() string {
+	if id := os.Getenv("INSTANCE_ID"); id != "" {
+		return id
+	}
+
+	hostname, _ := os.Hostname()
+	return hostname + "-" + uuid.NewString()
+}
+
+// webhookSecretKey returns the key of the WEBHOOK_SECRET_KEY environment variable, 32 hex encoded bytes,
+// or nil when it is not set.
+func webhookSecretKey() ([]byte, error) {
+	value := os.Getenv("WEBHOOK_SECRET_KEY")
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, crypto.ErrInvalidKey
+	}
+
+	return key, nil
 }
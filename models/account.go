@@ -33,7 +33,7 @@ type Account struct {
 	ClientSecret      string             `bson:"client_secret"`
 	Status            string             `bson:"token_status,omitempty"`
 	OrgID             string             `bson:"org_id"`
-	SubscribedObjects string             `bson:"subscribed_objects,omitempty"`
+	SubscribedObjects SubscribedObjects  `bson:"subscribed_objects,omitempty"`
 	CreatedAt         time.Time          `bson:"created_at,omitempty"`
 	UpdatedAt         time.Time          `bson:"updated_at,omitempty"`
 	DeletedAt         *time.Time         `bson:"deleted_at,omitempty"`
@@ -62,6 +62,41 @@ func (a *Account) Update(ctx context.Context) error {
 	return err
 }
 
+// UpdateToken stores the refreshed tokens and instance URL, leaving the other fields, e.g. the
+// subscribed objects, as they are stored.
+func (a *Account) UpdateToken(ctx context.Context) error {
+	filter := createFilter()
+	filter["_id"] = a.ID
+
+	a.UpdatedAt = time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"access_token":  a.AccessToken,
+			"refresh_token": a.RefreshToken,
+			"instance_url":  a.InstanceUrl,
+			"updated_at":    a.UpdatedAt,
+		},
+	}
+	_, err := a.getCollection().UpdateOne(ctx, filter, update)
+	return err
+}
+
+// UpdateSubscribedObjects replaces the subscribed objects, including when none are selected anymore.
+func (a *Account) UpdateSubscribedObjects(ctx context.Context) error {
+	filter := createFilter()
+	filter["_id"] = a.ID
+
+	a.UpdatedAt = time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"subscribed_objects": a.SubscribedObjects,
+			"updated_at":         a.UpdatedAt,
+		},
+	}
+	_, err := a.getCollection().UpdateOne(ctx, filter, update)
+	return err
+}
+
 func (a *Account) FindByID(ctx context.Context) error {
 	filter := createFilter()
 	filter["_id"] = a.ID
@@ -114,6 +149,22 @@ func (a *Account) FindByClientID(ctx context.Context) error {
 	return result.Decode(a)
 }
 
+func (a *Account) FindByOrgID(ctx context.Context) error {
+	filter := createFilter()
+	filter["org_id"] = a.OrgID
+
+	result := a.getCollection().FindOne(ctx, filter)
+	if result.Err() != nil {
+		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return ErrDataNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(a)
+}
+
 func (a *Account) FindAllByStatus(ctx context.Context, status AccountStatus) ([]Account, error) {
 	filter := createFilter()
 	filter["token_status"] = string(status)
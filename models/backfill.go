@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	BackfillCollection = "backfill"
+)
+
+type BackfillStatus string
+
+const (
+	BackfillStatusPending   BackfillStatus = "PENDING"
+	BackfillStatusCompleted BackfillStatus = "COMPLETED"
+)
+
+// Backfill is the snapshot of the existing records of an object taken before its subscription starts.
+// ReplayID is the position of the topic captured before the snapshot began, the subscription is started
+// from it once the snapshot is completed. StartEarliest is set when no position could be captured, the
+// subscription then starts from the earliest retained event until it has a checkpoint.
+type Backfill struct {
+	ID            primitive.ObjectID `bson:"_id,omitempty"`
+	OrgID         string             `bson:"org_id"`
+	TopicName     string             `bson:"topic_name"`
+	EntityName    string             `bson:"entity_name"`
+	ReplayID      []byte             `bson:"replay_id"`
+	StartEarliest bool               `bson:"start_earliest"`
+	Status        BackfillStatus     `bson:"status"`
+	Records       int64              `bson:"records"`
+	Error         string             `bson:"error"`
+	Attempts      int                `bson:"attempts"`
+	CreatedAt     time.Time          `bson:"created_at,omitempty"`
+	UpdatedAt     time.Time          `bson:"updated_at,omitempty"`
+	CompletedAt   *time.Time         `bson:"completed_at,omitempty"`
+}
+
+var backfillIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "topic_name", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	},
+}
+
+func (b *Backfill) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(BackfillCollection)
+}
+
+// Upsert schedules the backfill of the topic of the org, replacing a previous backfill of the topic.
+func (b *Backfill) Upsert(ctx context.Context) error {
+	now := time.Now()
+	filter := bson.M{
+		"org_id":     b.OrgID,
+		"topic_name": b.TopicName,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"entity_name":    b.EntityName,
+			"replay_id":      nil,
+			"start_earliest": false,
+			"status":         BackfillStatusPending,
+			"records":        int64(0),
+			"error":          "",
+			"attempts":       0,
+			"created_at":     now,
+			"updated_at":     now,
+		},
+		"$unset": bson.M{
+			"completed_at": "",
+		},
+	}
+
+	_, err := b.getCollection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	b.Status = BackfillStatusPending
+	b.CreatedAt = now
+	b.UpdatedAt = now
+	return nil
+}
+
+func (b *Backfill) Update(ctx context.Context) error {
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"replay_id":      b.ReplayID,
+			"start_earliest": b.StartEarliest,
+			"status":         b.Status,
+			"records":        b.Records,
+			"error":          b.Error,
+			"attempts":       b.Attempts,
+			"updated_at":     now,
+			"completed_at":   b.CompletedAt,
+		},
+	}
+
+	_, err := b.getCollection().UpdateOne(ctx, bson.M{"_id": b.ID}, update)
+	if err != nil {
+		return err
+	}
+
+	b.UpdatedAt = now
+	return nil
+}
+
+// FindByOrgIDAndTopic finds the latest backfill of the topic of the org.
+func (b *Backfill) FindByOrgIDAndTopic(ctx context.Context) error {
+	filter := bson.M{
+		"org_id":     b.OrgID,
+		"topic_name": b.TopicName,
+	}
+
+	result := b.getCollection().FindOne(ctx, filter)
+	if result.Err() != nil {
+		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return ErrDataNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(b)
+}
@@ -0,0 +1,75 @@
+package models
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	BroadcastEventCollection = "broadcast_event"
+
+	// BroadcastEventRetention is how long the broadcast events are kept for the other instances.
+	BroadcastEventRetention = time.Minute
+)
+
+// BroadcastEvent is an event broadcast by the instance holding the lease of its subscription, so that
+// the other instances publish it to their live event streams too. Instance is the ID of that instance.
+type BroadcastEvent struct {
+	ID            primitive.ObjectID     `bson:"_id,omitempty"`
+	Instance      string                 `bson:"instance"`
+	OrgID         string                 `bson:"org_id"`
+	TopicName     string                 `bson:"topic_name"`
+	ReplayID      []byte                 `bson:"replay_id"`
+	SchemaID      string                 `bson:"schema_id"`
+	Body          map[string]interface{} `bson:"body"`
+	ChangedFields []string               `bson:"changed_fields,omitempty"`
+	NulledFields  []string               `bson:"nulled_fields,omitempty"`
+	DiffFields    []string               `bson:"diff_fields,omitempty"`
+	CreatedAt     time.Time              `bson:"created_at"`
+}
+
+var broadcastEventIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(BroadcastEventRetention / time.Second)),
+	},
+}
+
+func (e *BroadcastEvent) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(BroadcastEventCollection)
+}
+
+func (e *BroadcastEvent) Save(ctx context.Context) error {
+	e.ID = primitive.NewObjectID()
+	e.CreatedAt = time.Now()
+
+	_, err := e.getCollection().InsertOne(ctx, e)
+	return err
+}
+
+// FindSinceFromOtherInstances returns the events broadcast since the given time by the instances other
+// than the instance of the event, in the order of their IDs.
+func (e *BroadcastEvent) FindSinceFromOtherInstances(ctx context.Context, since time.Time) ([]BroadcastEvent, error) {
+	filter := bson.M{
+		"_id":      bson.M{"$gte": primitive.NewObjectIDFromTimestamp(since)},
+		"instance": bson.M{"$ne": e.Instance},
+	}
+
+	cursor, err := e.getCollection().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	result := []BroadcastEvent{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
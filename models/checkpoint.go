@@ -0,0 +1,85 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	CheckpointCollection = "checkpoint"
+)
+
+// Checkpoint records the replay ID of the last event processed for a topic of an org,
+// so that a subscription can be resumed from that point after a restart.
+type Checkpoint struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	OrgID     string             `bson:"org_id"`
+	TopicName string             `bson:"topic_name"`
+	ReplayID  []byte             `bson:"replay_id"`
+	CreatedAt time.Time          `bson:"created_at,omitempty"`
+	UpdatedAt time.Time          `bson:"updated_at,omitempty"`
+}
+
+var checkpointIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "topic_name", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	},
+}
+
+func (c *Checkpoint) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(CheckpointCollection)
+}
+
+func (c *Checkpoint) Upsert(ctx context.Context) error {
+	now := time.Now()
+	filter := bson.M{
+		"org_id":     c.OrgID,
+		"topic_name": c.TopicName,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"replay_id":  c.ReplayID,
+			"updated_at": now,
+		},
+		"$setOnInsert": bson.M{
+			"created_at": now,
+		},
+	}
+
+	_, err := c.getCollection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	c.UpdatedAt = now
+	return nil
+}
+
+func (c *Checkpoint) FindByOrgIDAndTopic(ctx context.Context) error {
+	filter := bson.M{
+		"org_id":     c.OrgID,
+		"topic_name": c.TopicName,
+	}
+
+	result := c.getCollection().FindOne(ctx, filter)
+	if result.Err() != nil {
+		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return ErrDataNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(c)
+}
@@ -0,0 +1,170 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DeadLetterCollection = "dead_letter"
+)
+
+type DeadLetterStatus string
+
+const (
+	DeadLetterStatusPending   DeadLetterStatus = "PENDING"
+	DeadLetterStatusRetried   DeadLetterStatus = "RETRIED"
+	DeadLetterStatusDiscarded DeadLetterStatus = "DISCARDED"
+)
+
+// DeadLetter is an event that could not be decoded or handled, with its raw payload so that it can be
+// retried later. Retried and discarded dead letters are soft deleted.
+type DeadLetter struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	OrgID     string             `bson:"org_id"`
+	TopicName string             `bson:"topic_name"`
+	ReplayID  []byte             `bson:"replay_id"`
+	SchemaID  string             `bson:"schema_id"`
+	Payload   []byte             `bson:"payload"`
+	Error     string             `bson:"error"`
+	Attempts  int                `bson:"attempts"`
+	Status    DeadLetterStatus   `bson:"status"`
+	CreatedAt time.Time          `bson:"created_at,omitempty"`
+	UpdatedAt time.Time          `bson:"updated_at,omitempty"`
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty"`
+}
+
+var deadLetterIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "topic_name", Value: 1},
+			{Key: "replay_id", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	},
+}
+
+func (d *DeadLetter) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(DeadLetterCollection)
+}
+
+// Upsert stores the dead letter as pending. When the event has already been dead-lettered,
+// e.g. because it was received again, its error is replaced and its attempts are added.
+func (d *DeadLetter) Upsert(ctx context.Context) error {
+	now := time.Now()
+	filter := bson.M{
+		"org_id":     d.OrgID,
+		"topic_name": d.TopicName,
+		"replay_id":  d.ReplayID,
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"schema_id":  d.SchemaID,
+			"payload":    d.Payload,
+			"error":      d.Error,
+			"status":     DeadLetterStatusPending,
+			"updated_at": now,
+		},
+		"$inc": bson.M{
+			"attempts": d.Attempts,
+		},
+		"$unset": bson.M{
+			"deleted_at": "",
+		},
+		"$setOnInsert": bson.M{
+			"created_at": now,
+		},
+	}
+
+	_, err := d.getCollection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// Update stores the error and attempts of a retry that failed.
+func (d *DeadLetter) Update(ctx context.Context) error {
+	filter := createFilter()
+	filter["_id"] = d.ID
+
+	d.UpdatedAt = time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"error":      d.Error,
+			"attempts":   d.Attempts,
+			"updated_at": d.UpdatedAt,
+		},
+	}
+	_, err := d.getCollection().UpdateOne(ctx, filter, update)
+	return err
+}
+
+// Delete soft deletes the dead letter with the given status, i.e. retried or discarded.
+func (d *DeadLetter) Delete(ctx context.Context, status DeadLetterStatus) error {
+	filter := createFilter()
+	filter["_id"] = d.ID
+
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"status":     status,
+			"updated_at": now,
+			"deleted_at": now,
+		},
+	}
+	result, err := d.getCollection().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrDataNotFound
+	}
+
+	d.Status = status
+	d.UpdatedAt = now
+	d.DeletedAt = &now
+	return nil
+}
+
+func (d *DeadLetter) FindByID(ctx context.Context) error {
+	filter := createFilter()
+	filter["_id"] = d.ID
+
+	result := d.getCollection().FindOne(ctx, filter)
+	if result.Err() != nil {
+		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return ErrDataNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(d)
+}
+
+// FindAllByOrgID returns the pending dead letters of the org, or of all orgs when OrgID is empty, oldest first.
+func (d *DeadLetter) FindAllByOrgID(ctx context.Context) ([]DeadLetter, error) {
+	filter := createFilter()
+	if d.OrgID != "" {
+		filter["org_id"] = d.OrgID
+	}
+
+	cursor, err := d.getCollection().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	result := []DeadLetter{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package models
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	DeliveredEventCollection = "delivered_event"
+)
+
+// DeliveredEvent records that an event is being handled or has been handled, so that it is dropped when it
+// is received again. It is removed by a TTL index once it expires.
+type DeliveredEvent struct {
+	Key         string    `bson:"_id"`
+	OrgID       string    `bson:"org_id"`
+	TopicName   string    `bson:"topic_name"`
+	DeliveredAt time.Time `bson:"delivered_at"`
+	ExpiresAt   time.Time `bson:"expires_at"`
+}
+
+var deliveredEventIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	},
+}
+
+func (d *DeliveredEvent) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(DeliveredEventCollection)
+}
+
+// Claim claims the event for handling until ExpiresAt and reports whether it was claimed. An event that
+// has already been delivered or is claimed by another handler, and whose entry has not expired yet, is not
+// claimed: the upsert of its filter inserts a document with the same _id, which fails with a duplicate key error.
+func (d *DeliveredEvent) Claim(ctx context.Context) (bool, error) {
+	now := time.Now()
+	filter := bson.M{
+		"_id":        d.Key,
+		"expires_at": bson.M{"$lte": now},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"org_id":       d.OrgID,
+			"topic_name":   d.TopicName,
+			"delivered_at": now,
+			"expires_at":   d.ExpiresAt,
+		},
+	}
+
+	_, err := d.getCollection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	d.DeliveredAt = now
+	return true, nil
+}
+
+// Confirm records that the claimed event has been delivered, it is kept until ExpiresAt.
+func (d *DeliveredEvent) Confirm(ctx context.Context) error {
+	d.DeliveredAt = time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"delivered_at": d.DeliveredAt,
+			"expires_at":   d.ExpiresAt,
+		},
+	}
+
+	_, err := d.getCollection().UpdateOne(ctx, bson.M{"_id": d.Key}, update)
+	return err
+}
+
+// Release removes the claim of the event, so that it is handled again when it is received again.
+func (d *DeliveredEvent) Release(ctx context.Context) error {
+	_, err := d.getCollection().DeleteMany(ctx, bson.M{"_id": d.Key})
+	return err
+}
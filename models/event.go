@@ -1,3 +1,138 @@
 package models
 
-type Event struct{}
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	EventCollection = "event"
+)
+
+// Event is a decoded event received from Salesforce. The entity name, change type,
+// record IDs and commit timestamp are only set for change data capture events.
+type Event struct {
+	ID              primitive.ObjectID     `bson:"_id,omitempty"`
+	OrgID           string                 `bson:"org_id"`
+	TopicName       string                 `bson:"topic_name"`
+	ReplayID        []byte                 `bson:"replay_id"`
+	SchemaID        string                 `bson:"schema_id"`
+	EntityName      string                 `bson:"entity_name,omitempty"`
+	ChangeType      string                 `bson:"change_type,omitempty"`
+	RecordIDs       []string               `bson:"record_ids,omitempty"`
+	CommitTimestamp time.Time              `bson:"commit_timestamp"`
+	ChangedFields   []string               `bson:"changed_fields,omitempty"`
+	NulledFields    []string               `bson:"nulled_fields,omitempty"`
+	DiffFields      []string               `bson:"diff_fields,omitempty"`
+	Payload         map[string]interface{} `bson:"payload"`
+	CreatedAt       time.Time              `bson:"created_at,omitempty"`
+}
+
+var eventIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "topic_name", Value: 1},
+			{Key: "commit_timestamp", Value: 1},
+		},
+	},
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "topic_name", Value: 1},
+			{Key: "replay_id", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	},
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "_id", Value: 1},
+		},
+	},
+}
+
+// EventRange selects the stored events of an org, of the given topics or of all topics when none is given,
+// committed between From and To and with a replay ID between FromReplayID and ToReplayID. The bounds are
+// inclusive and a zero bound is open. Replay IDs are only ordered within a topic.
+type EventRange struct {
+	OrgID        string
+	TopicNames   []string
+	From         time.Time
+	To           time.Time
+	FromReplayID []byte
+	ToReplayID   []byte
+}
+
+func (e *Event) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(EventCollection)
+}
+
+// Save stores the event, an event that has already been stored is ignored.
+func (e *Event) Save(ctx context.Context) error {
+	e.ID = primitive.NewObjectID()
+	e.CreatedAt = time.Now()
+
+	_, err := e.getCollection().InsertOne(ctx, e)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+
+	return err
+}
+
+// FindRange returns up to limit events of the range stored after the event with the ID after,
+// or from the first event when after is zero, in the order they were stored.
+func (e *Event) FindRange(ctx context.Context, r EventRange, after primitive.ObjectID, limit int64) ([]Event, error) {
+	filter := bson.M{"org_id": r.OrgID}
+	if len(r.TopicNames) > 0 {
+		filter["topic_name"] = bson.M{"$in": r.TopicNames}
+	}
+	if !after.IsZero() {
+		filter["_id"] = bson.M{"$gt": after}
+	}
+
+	committed := bson.M{}
+	if !r.From.IsZero() {
+		committed["$gte"] = r.From
+	}
+	if !r.To.IsZero() {
+		committed["$lte"] = r.To
+	}
+	if len(committed) > 0 {
+		filter["commit_timestamp"] = committed
+	}
+
+	replayID := bson.M{}
+	if len(r.FromReplayID) > 0 {
+		replayID["$gte"] = r.FromReplayID
+	}
+	if len(r.ToReplayID) > 0 {
+		replayID["$lte"] = r.ToReplayID
+	}
+	if len(replayID) > 0 {
+		filter["replay_id"] = replayID
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(limit)
+
+	cursor, err := e.getCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Event{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,124 @@
+package models
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	mirrorCollectionPrefix = "mirror_"
+)
+
+// MirroredRecord is a copy of a Salesforce record kept up to date from its change events. The records
+// of every object of an org are stored in their own collection, e.g. mirror_<org ID>_Account, keyed by
+// record ID, with the fields of the record next to the org_id, commit_timestamp, mirrored_at and
+// deleted_at fields of the mirror.
+//
+// A write is only applied when its commit timestamp is not older than the commit timestamp of the mirrored
+// record, so that an event handled out of order, e.g. after a snapshot, doesn't revert a newer change.
+type MirroredRecord struct {
+	OrgID           string
+	EntityName      string
+	RecordID        string
+	CommitTimestamp time.Time
+}
+
+// MirrorCollection returns the collection of the records of the object of the org.
+func MirrorCollection(orgID, entityName string) string {
+	return mirrorCollectionPrefix + orgID + "_" + entityName
+}
+
+func (r *MirroredRecord) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(MirrorCollection(r.OrgID, r.EntityName))
+}
+
+// filter matches the record unless it has been written by a newer change. The upsert of a record that
+// doesn't match inserts a document with the same _id, which fails with a duplicate key error.
+func (r *MirroredRecord) filter() bson.M {
+	return bson.M{
+		"_id": r.RecordID,
+		"$or": bson.A{
+			bson.M{"commit_timestamp": bson.M{"$lte": r.CommitTimestamp}},
+			bson.M{"commit_timestamp": bson.M{"$exists": false}},
+		},
+	}
+}
+
+// skipStale ignores the error of a write that has been skipped because the record has a newer change.
+func skipStale(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (r *MirroredRecord) metadata() bson.M {
+	return bson.M{
+		"org_id":           r.OrgID,
+		"commit_timestamp": r.CommitTimestamp,
+		"mirrored_at":      time.Now(),
+	}
+}
+
+// Merge sets the fields, which may be paths of compound fields, e.g. Name.FirstName, and removes
+// the unset fields, creating the record if it doesn't exist.
+func (r *MirroredRecord) Merge(ctx context.Context, fields map[string]interface{}, unset []string) error {
+	set := r.metadata()
+	for name, value := range fields {
+		set[name] = value
+	}
+
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		remove := bson.M{}
+		for _, name := range unset {
+			remove[name] = ""
+		}
+		update["$unset"] = remove
+	}
+
+	_, err := r.getCollection().UpdateOne(ctx, r.filter(), update, options.Update().SetUpsert(true))
+	return skipStale(err)
+}
+
+// Replace replaces all fields of the record, creating it if it doesn't exist.
+func (r *MirroredRecord) Replace(ctx context.Context, fields map[string]interface{}) error {
+	replacement := r.metadata()
+	for name, value := range fields {
+		replacement[name] = value
+	}
+	replacement["_id"] = r.RecordID
+
+	_, err := r.getCollection().ReplaceOne(ctx, r.filter(), replacement, options.Replace().SetUpsert(true))
+	return skipStale(err)
+}
+
+// Delete soft deletes the record.
+func (r *MirroredRecord) Delete(ctx context.Context) error {
+	set := r.metadata()
+	set["deleted_at"] = r.CommitTimestamp
+
+	_, err := r.getCollection().UpdateOne(ctx, r.filter(), bson.M{"$set": set}, options.Update().SetUpsert(true))
+	return skipStale(err)
+}
+
+// Undelete restores a soft deleted record and sets its fields.
+func (r *MirroredRecord) Undelete(ctx context.Context, fields map[string]interface{}) error {
+	set := r.metadata()
+	for name, value := range fields {
+		set[name] = value
+	}
+
+	update := bson.M{
+		"$set":   set,
+		"$unset": bson.M{"deleted_at": ""},
+	}
+	_, err := r.getCollection().UpdateOne(ctx, r.filter(), update, options.Update().SetUpsert(true))
+	return skipStale(err)
+}
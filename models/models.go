@@ -1,9 +1,12 @@
 package models
 
 import (
+	"context"
 	"errors"
+	"github/michaellimmm/salesforce-app-example/db"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 var (
@@ -19,3 +22,29 @@ func createFilter() bson.M {
 	}
 	return filter
 }
+
+// CreateIndexes creates the indexes of all collections, existing indexes are left untouched.
+func CreateIndexes(ctx context.Context) error {
+	indexes := map[string][]mongo.IndexModel{
+		BackfillCollection:        backfillIndexes,
+		BroadcastEventCollection:  broadcastEventIndexes,
+		CheckpointCollection:      checkpointIndexes,
+		DeadLetterCollection:      deadLetterIndexes,
+		DeliveredEventCollection:  deliveredEventIndexes,
+		EventCollection:           eventIndexes,
+		ReconciliationCollection:  reconciliationIndexes,
+		ReplayJobCollection:       replayJobIndexes,
+		SchemaCollection:          schemaIndexes,
+		WebhookCollection:         webhookIndexes,
+		WebhookDeliveryCollection: webhookDeliveryIndexes,
+		WebhookOutboxCollection:   webhookOutboxIndexes,
+	}
+
+	for collection, models := range indexes {
+		if _, err := db.Datastore.Collection(collection).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ReconciliationCollection = "reconciliation"
+)
+
+type ReconciliationStatus string
+
+const (
+	ReconciliationStatusPending   ReconciliationStatus = "PENDING"
+	ReconciliationStatusCompleted ReconciliationStatus = "COMPLETED"
+)
+
+// Reconciliation is the snapshot of all records of an object requested by a gap event that carries no
+// record IDs, e.g. GAP_OVERFLOW. It is stored before the gap event is checkpointed and stays pending
+// until a snapshot started after the latest request has completed, so that it survives a restart.
+// ReplayID is the replay ID of the gap event of the latest request.
+type Reconciliation struct {
+	ID          primitive.ObjectID   `bson:"_id,omitempty"`
+	OrgID       string               `bson:"org_id"`
+	TopicName   string               `bson:"topic_name"`
+	EntityName  string               `bson:"entity_name"`
+	ReplayID    []byte               `bson:"replay_id"`
+	Status      ReconciliationStatus `bson:"status"`
+	Records     int64                `bson:"records"`
+	Error       string               `bson:"error"`
+	Attempts    int                  `bson:"attempts"`
+	RequestedAt time.Time            `bson:"requested_at"`
+	CreatedAt   time.Time            `bson:"created_at,omitempty"`
+	UpdatedAt   time.Time            `bson:"updated_at,omitempty"`
+	CompletedAt *time.Time           `bson:"completed_at,omitempty"`
+}
+
+var reconciliationIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "topic_name", Value: 1},
+			{Key: "entity_name", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	},
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "topic_name", Value: 1},
+			{Key: "status", Value: 1},
+		},
+	},
+}
+
+func (r *Reconciliation) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(ReconciliationCollection)
+}
+
+func (r *Reconciliation) objectFilter() bson.M {
+	return bson.M{
+		"org_id":      r.OrgID,
+		"topic_name":  r.TopicName,
+		"entity_name": r.EntityName,
+	}
+}
+
+// Request requests the reconciliation of the object of the org, which is pending until it is completed.
+func (r *Reconciliation) Request(ctx context.Context) error {
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"replay_id":    r.ReplayID,
+			"status":       ReconciliationStatusPending,
+			"requested_at": now,
+			"updated_at":   now,
+		},
+		"$setOnInsert": bson.M{
+			"created_at": now,
+		},
+		"$unset": bson.M{
+			"completed_at": "",
+		},
+	}
+
+	_, err := r.getCollection().UpdateOne(ctx, r.objectFilter(), update, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	r.Status = ReconciliationStatusPending
+	r.RequestedAt = now
+	r.UpdatedAt = now
+	return nil
+}
+
+// Update stores the progress of a failed attempt.
+func (r *Reconciliation) Update(ctx context.Context) error {
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"records":    r.Records,
+			"error":      r.Error,
+			"attempts":   r.Attempts,
+			"updated_at": now,
+		},
+	}
+
+	_, err := r.getCollection().UpdateOne(ctx, bson.M{"_id": r.ID}, update)
+	if err != nil {
+		return err
+	}
+
+	r.UpdatedAt = now
+	return nil
+}
+
+// Complete marks the reconciliation completed unless it has been requested again since it was found,
+// in which case false is returned and it stays pending.
+func (r *Reconciliation) Complete(ctx context.Context) (bool, error) {
+	filter := bson.M{
+		"_id":          r.ID,
+		"requested_at": r.RequestedAt,
+	}
+
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"status":       ReconciliationStatusCompleted,
+			"records":      r.Records,
+			"error":        "",
+			"attempts":     r.Attempts,
+			"updated_at":   now,
+			"completed_at": now,
+		},
+	}
+	result, err := r.getCollection().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	r.UpdatedAt = now
+	return result.MatchedCount > 0, nil
+}
+
+// FindPendingByObject finds the pending reconciliation of the object of the org.
+func (r *Reconciliation) FindPendingByObject(ctx context.Context) error {
+	filter := r.objectFilter()
+	filter["status"] = ReconciliationStatusPending
+
+	result := r.getCollection().FindOne(ctx, filter)
+	if result.Err() != nil {
+		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return ErrDataNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(r)
+}
+
+// FindAllPendingByOrgIDAndTopic returns the pending reconciliations of the topic of the org.
+func (r *Reconciliation) FindAllPendingByOrgIDAndTopic(ctx context.Context) ([]Reconciliation, error) {
+	filter := bson.M{
+		"org_id":     r.OrgID,
+		"topic_name": r.TopicName,
+		"status":     ReconciliationStatusPending,
+	}
+
+	cursor, err := r.getCollection().Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Reconciliation{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
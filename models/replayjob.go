@@ -0,0 +1,173 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ReplayJobCollection = "replay_job"
+)
+
+type ReplayJobStatus string
+
+const (
+	ReplayJobStatusPending   ReplayJobStatus = "PENDING"
+	ReplayJobStatusRunning   ReplayJobStatus = "RUNNING"
+	ReplayJobStatusCompleted ReplayJobStatus = "COMPLETED"
+	ReplayJobStatusFailed    ReplayJobStatus = "FAILED"
+	ReplayJobStatusCanceled  ReplayJobStatus = "CANCELED"
+)
+
+// ReplayJob re-dispatches the stored events of a range to some of the registered handlers. Cursor is the ID
+// of the last event dispatched, so that a job that is interrupted continues with the next event.
+type ReplayJob struct {
+	ID           primitive.ObjectID `bson:"_id,omitempty"`
+	OrgID        string             `bson:"org_id"`
+	TopicNames   []string           `bson:"topic_names,omitempty"`
+	Sinks        []string           `bson:"sinks"`
+	From         time.Time          `bson:"from,omitempty"`
+	To           time.Time          `bson:"to,omitempty"`
+	FromReplayID []byte             `bson:"from_replay_id,omitempty"`
+	ToReplayID   []byte             `bson:"to_replay_id,omitempty"`
+	// Rate is the maximum number of events dispatched per second
+	Rate        int                `bson:"rate"`
+	Status      ReplayJobStatus    `bson:"status"`
+	Cursor      primitive.ObjectID `bson:"cursor,omitempty"`
+	Replayed    int64              `bson:"replayed"`
+	Error       string             `bson:"error"`
+	CreatedAt   time.Time          `bson:"created_at,omitempty"`
+	UpdatedAt   time.Time          `bson:"updated_at,omitempty"`
+	CompletedAt *time.Time         `bson:"completed_at,omitempty"`
+}
+
+var replayJobIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "created_at", Value: -1},
+		},
+	},
+	{
+		Keys: bson.D{
+			{Key: "status", Value: 1},
+		},
+	},
+}
+
+func (j *ReplayJob) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(ReplayJobCollection)
+}
+
+// Range returns the range of the stored events replayed by the job.
+func (j *ReplayJob) Range() EventRange {
+	return EventRange{
+		OrgID:        j.OrgID,
+		TopicNames:   j.TopicNames,
+		From:         j.From,
+		To:           j.To,
+		FromReplayID: j.FromReplayID,
+		ToReplayID:   j.ToReplayID,
+	}
+}
+
+func (j *ReplayJob) Save(ctx context.Context) error {
+	now := time.Now()
+	j.ID = primitive.NewObjectID()
+	j.CreatedAt = now
+	j.UpdatedAt = now
+
+	_, err := j.getCollection().InsertOne(ctx, j)
+	return err
+}
+
+// Update stores the status and the progress of the job, unless its status is no longer one of from,
+// e.g. because it has been canceled in the meantime, in which case false is returned.
+func (j *ReplayJob) Update(ctx context.Context, from ...ReplayJobStatus) (bool, error) {
+	filter := bson.M{
+		"_id":    j.ID,
+		"status": bson.M{"$in": from},
+	}
+
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"status":       j.Status,
+			"cursor":       j.Cursor,
+			"replayed":     j.Replayed,
+			"error":        j.Error,
+			"updated_at":   now,
+			"completed_at": j.CompletedAt,
+		},
+	}
+	result, err := j.getCollection().UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	j.UpdatedAt = now
+	return result.MatchedCount > 0, nil
+}
+
+func (j *ReplayJob) FindByID(ctx context.Context) error {
+	result := j.getCollection().FindOne(ctx, bson.M{"_id": j.ID})
+	if result.Err() != nil {
+		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return ErrDataNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(j)
+}
+
+// FindLatestByOrgID returns the latest jobs of the org, or of all orgs when OrgID is empty, newest first.
+func (j *ReplayJob) FindLatestByOrgID(ctx context.Context, limit int64) ([]ReplayJob, error) {
+	filter := bson.M{}
+	if j.OrgID != "" {
+		filter["org_id"] = j.OrgID
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetLimit(limit)
+
+	cursor, err := j.getCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []ReplayJob{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// FindAllUnfinished returns the pending and running jobs of all orgs, oldest first.
+func (j *ReplayJob) FindAllUnfinished(ctx context.Context) ([]ReplayJob, error) {
+	filter := bson.M{
+		"status": bson.M{"$in": []ReplayJobStatus{ReplayJobStatusPending, ReplayJobStatusRunning}},
+	}
+
+	cursor, err := j.getCollection().Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	result := []ReplayJob{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	SchemaCollection = "schema"
+)
+
+// Schema is a version of the Avro schema of a topic seen in an org.
+type Schema struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	OrgID       string             `bson:"org_id"`
+	TopicName   string             `bson:"topic_name"`
+	SchemaID    string             `bson:"schema_id"`
+	SchemaJSON  string             `bson:"schema_json"`
+	FirstSeenAt time.Time          `bson:"first_seen_at"`
+}
+
+var schemaIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "topic_name", Value: 1},
+			{Key: "schema_id", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	},
+	{
+		Keys: bson.D{
+			{Key: "schema_id", Value: 1},
+		},
+	},
+}
+
+func (s *Schema) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(SchemaCollection)
+}
+
+// SaveIfNotExists stores the schema version unless it has already been seen for the org and topic,
+// and reports whether it was stored.
+func (s *Schema) SaveIfNotExists(ctx context.Context) (bool, error) {
+	s.FirstSeenAt = time.Now()
+	filter := bson.M{
+		"org_id":     s.OrgID,
+		"topic_name": s.TopicName,
+		"schema_id":  s.SchemaID,
+	}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"schema_json":   s.SchemaJSON,
+			"first_seen_at": s.FirstSeenAt,
+		},
+	}
+
+	result, err := s.getCollection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+
+	return result.UpsertedCount > 0, nil
+}
+
+func (s *Schema) FindAll(ctx context.Context) ([]Schema, error) {
+	return s.find(ctx, bson.M{})
+}
+
+// FindAllByOrgIDAndTopic returns the schema versions of the topic, oldest first.
+func (s *Schema) FindAllByOrgIDAndTopic(ctx context.Context) ([]Schema, error) {
+	filter := bson.M{
+		"org_id":     s.OrgID,
+		"topic_name": s.TopicName,
+	}
+
+	return s.find(ctx, filter)
+}
+
+func (s *Schema) find(ctx context.Context, filter bson.M) ([]Schema, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "first_seen_at", Value: 1}})
+	cursor, err := s.getCollection().Find(ctx, filter, opts)
+	if err != nil {
+		return []Schema{}, err
+	}
+
+	var result []Schema
+	if err = cursor.All(ctx, &result); err != nil {
+		return []Schema{}, err
+	}
+
+	return result, nil
+}
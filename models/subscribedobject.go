@@ -0,0 +1,59 @@
+package models
+
+import (
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// SubscribedObject is an object selected for change notifications, with the settings of its subscription.
+// Empty settings fall back to the defaults of the service.
+type SubscribedObject struct {
+	Name           string   `bson:"name"`
+	ReplayPolicy   string   `bson:"replay_policy,omitempty"`
+	NumRequested   int32    `bson:"num_requested,omitempty"`
+	MaxInFlight    int      `bson:"max_in_flight,omitempty"`
+	EnrichedFields []string `bson:"enriched_fields,omitempty"`
+	// ID of the change data capture channel member created by the app for the object, if any
+	ChannelMemberID string `bson:"channel_member_id,omitempty"`
+}
+
+type SubscribedObjects []SubscribedObject
+
+// UnmarshalBSONValue also accepts the comma-joined object names stored by earlier versions.
+func (o *SubscribedObjects) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	raw := bson.RawValue{Type: t, Value: data}
+
+	switch t {
+	case bsontype.Null:
+		*o = nil
+		return nil
+	case bsontype.String:
+		*o = nil
+		for _, name := range strings.Split(raw.StringValue(), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				*o = append(*o, SubscribedObject{Name: name})
+			}
+		}
+		return nil
+	}
+
+	var objects []SubscribedObject
+	if err := raw.Unmarshal(&objects); err != nil {
+		return err
+	}
+
+	*o = objects
+	return nil
+}
+
+func (o SubscribedObjects) Find(name string) (SubscribedObject, bool) {
+	for _, object := range o {
+		if object.Name == name {
+			return object, true
+		}
+	}
+
+	return SubscribedObject{}, false
+}
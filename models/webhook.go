@@ -0,0 +1,154 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	WebhookCollection         = "webhook"
+	WebhookDeliveryCollection = "webhook_delivery"
+
+	// WebhookRetention is how long the delivery attempts and the delivered and failed events of the outbox are kept.
+	WebhookRetention = 7 * 24 * time.Hour
+)
+
+// Webhook is the endpoint the events of an account are posted to. The events of all subscribed
+// objects are posted when no topics are selected. Secret is encrypted when the service is given a
+// webhook secret key.
+type Webhook struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	OrgID     string             `bson:"org_id"`
+	URL       string             `bson:"url"`
+	Secret    string             `bson:"secret"`
+	Topics    []string           `bson:"topics,omitempty"`
+	CreatedAt time.Time          `bson:"created_at,omitempty"`
+	UpdatedAt time.Time          `bson:"updated_at,omitempty"`
+	DeletedAt *time.Time         `bson:"deleted_at,omitempty"`
+}
+
+// WebhookDelivery is an attempt to post an event to a webhook. It is removed by a TTL index
+// WebhookRetention after it was made.
+type WebhookDelivery struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	WebhookID  primitive.ObjectID `bson:"webhook_id"`
+	OrgID      string             `bson:"org_id"`
+	TopicName  string             `bson:"topic_name"`
+	ReplayID   []byte             `bson:"replay_id"`
+	Attempt    int                `bson:"attempt"`
+	StatusCode int                `bson:"status_code,omitempty"`
+	Error      string             `bson:"error,omitempty"`
+	Duration   time.Duration      `bson:"duration"`
+	CreatedAt  time.Time          `bson:"created_at,omitempty"`
+}
+
+var webhookIndexes = []mongo.IndexModel{
+	{
+		Keys:    bson.D{{Key: "org_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	},
+}
+
+var webhookDeliveryIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{
+			{Key: "org_id", Value: 1},
+			{Key: "created_at", Value: -1},
+		},
+	},
+	{
+		Keys:    bson.D{{Key: "created_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(int32(WebhookRetention / time.Second)),
+	},
+}
+
+func (w *Webhook) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(WebhookCollection)
+}
+
+// Upsert stores the webhook of the org, replacing the previous one.
+func (w *Webhook) Upsert(ctx context.Context) error {
+	now := time.Now()
+	filter := bson.M{"org_id": w.OrgID}
+	update := bson.M{
+		"$set": bson.M{
+			"url":        w.URL,
+			"secret":     w.Secret,
+			"topics":     w.Topics,
+			"updated_at": now,
+		},
+		"$unset": bson.M{
+			"deleted_at": "",
+		},
+		"$setOnInsert": bson.M{
+			"created_at": now,
+		},
+	}
+
+	_, err := w.getCollection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// Delete soft deletes the webhook of the org.
+func (w *Webhook) Delete(ctx context.Context) error {
+	filter := createFilter()
+	filter["org_id"] = w.OrgID
+
+	now := time.Now()
+	_, err := w.getCollection().UpdateOne(ctx, filter, bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}})
+	return err
+}
+
+func (w *Webhook) FindByOrgID(ctx context.Context) error {
+	filter := createFilter()
+	filter["org_id"] = w.OrgID
+
+	result := w.getCollection().FindOne(ctx, filter)
+	if result.Err() != nil {
+		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return ErrDataNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(w)
+}
+
+func (d *WebhookDelivery) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(WebhookDeliveryCollection)
+}
+
+func (d *WebhookDelivery) Save(ctx context.Context) error {
+	d.ID = primitive.NewObjectID()
+	d.CreatedAt = time.Now()
+
+	_, err := d.getCollection().InsertOne(ctx, d)
+	return err
+}
+
+// FindLatestByOrgID returns the latest delivery attempts of the org, newest first.
+func (d *WebhookDelivery) FindLatestByOrgID(ctx context.Context, limit int64) ([]WebhookDelivery, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "created_at", Value: -1}}).
+		SetLimit(limit)
+
+	cursor, err := d.getCollection().Find(ctx, bson.M{"org_id": d.OrgID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []WebhookDelivery{}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
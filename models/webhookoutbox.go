@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/db"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	WebhookOutboxCollection = "webhook_outbox"
+)
+
+type WebhookOutboxStatus string
+
+const (
+	WebhookOutboxStatusPending   WebhookOutboxStatus = "PENDING"
+	WebhookOutboxStatusDelivered WebhookOutboxStatus = "DELIVERED"
+	WebhookOutboxStatusFailed    WebhookOutboxStatus = "FAILED"
+)
+
+// WebhookOutbox is an event waiting to be posted to the webhook of its org. Key identifies the event,
+// it is only pending once at a time. A worker claims it until LockedUntil, and a delivered or failed
+// event is removed by a TTL index once it expires.
+type WebhookOutbox struct {
+	ID            primitive.ObjectID  `bson:"_id,omitempty"`
+	Key           string              `bson:"key"`
+	OrgID         string              `bson:"org_id"`
+	TopicName     string              `bson:"topic_name"`
+	ReplayID      []byte              `bson:"replay_id"`
+	Body          []byte              `bson:"body"`
+	Status        WebhookOutboxStatus `bson:"status"`
+	Attempts      int                 `bson:"attempts"`
+	Error         string              `bson:"error,omitempty"`
+	NextAttemptAt time.Time           `bson:"next_attempt_at"`
+	LockedUntil   time.Time           `bson:"locked_until"`
+	CreatedAt     time.Time           `bson:"created_at,omitempty"`
+	UpdatedAt     time.Time           `bson:"updated_at,omitempty"`
+	ExpiresAt     *time.Time          `bson:"expires_at,omitempty"`
+}
+
+var webhookOutboxIndexes = []mongo.IndexModel{
+	{
+		Keys: bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{"status": WebhookOutboxStatusPending}),
+	},
+	{
+		Keys: bson.D{
+			{Key: "status", Value: 1},
+			{Key: "next_attempt_at", Value: 1},
+		},
+	},
+	{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	},
+}
+
+func (o *WebhookOutbox) getCollection() db.CollectionProvider {
+	return db.Datastore.Collection(WebhookOutboxCollection)
+}
+
+// Enqueue stores the event as pending, unless the same event is already pending.
+func (o *WebhookOutbox) Enqueue(ctx context.Context) error {
+	now := time.Now()
+	filter := bson.M{
+		"key":    o.Key,
+		"status": WebhookOutboxStatusPending,
+	}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"org_id":          o.OrgID,
+			"topic_name":      o.TopicName,
+			"replay_id":       o.ReplayID,
+			"body":            o.Body,
+			"attempts":        0,
+			"next_attempt_at": now,
+			"locked_until":    time.Time{},
+			"created_at":      now,
+			"updated_at":      now,
+		},
+	}
+
+	_, err := o.getCollection().UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+
+	return err
+}
+
+// ClaimNext claims the pending event that is due the longest until lockedUntil, so that no other worker
+// posts it in the meantime. ErrDataNotFound is returned when no event is due.
+func (o *WebhookOutbox) ClaimNext(ctx context.Context, lockedUntil time.Time) error {
+	now := time.Now()
+	filter := bson.M{
+		"status":          WebhookOutboxStatusPending,
+		"next_attempt_at": bson.M{"$lte": now},
+		"locked_until":    bson.M{"$lte": now},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"locked_until": lockedUntil,
+			"updated_at":   now,
+		},
+	}
+	opts := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	result := o.getCollection().FindOneAndUpdate(ctx, filter, update, opts)
+	if result.Err() != nil {
+		if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+			return ErrDataNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(o)
+}
+
+// Update stores the outcome of a delivery attempt and releases the claim of the event.
+func (o *WebhookOutbox) Update(ctx context.Context) error {
+	o.UpdatedAt = time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"status":          o.Status,
+			"attempts":        o.Attempts,
+			"error":           o.Error,
+			"next_attempt_at": o.NextAttemptAt,
+			"locked_until":    time.Time{},
+			"updated_at":      o.UpdatedAt,
+			"expires_at":      o.ExpiresAt,
+		},
+	}
+
+	_, err := o.getCollection().UpdateOne(ctx, bson.M{"_id": o.ID}, update)
+	return err
+}
@@ -0,0 +1,162 @@
+package pubsubclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/linkedin/goavro/v2"
+)
+
+type (
+	// schema is a cached Avro schema with the field positions needed to decode
+	// the bitmap fields of change event headers.
+	schema struct {
+		json   string
+		codec  *goavro.Codec
+		fields []schemaField
+	}
+
+	schemaField struct {
+		name string
+		// fields of a compound field, e.g. the parts of a Name or Address field
+		fields []schemaField
+	}
+)
+
+func newSchema(schemaJSON string) (*schema, error) {
+	codec, err := goavro.NewCodec(schemaJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal([]byte(schemaJSON), &raw); err != nil {
+		return nil, err
+	}
+
+	return &schema{
+		json:   schemaJSON,
+		codec:  codec,
+		fields: recordFields(raw, make(map[string][]schemaField)),
+	}, nil
+}
+
+// SchemaFieldPaths returns the paths of all fields of the record schema, including the fields
+// of compound fields, e.g. "Name" and "Name.FirstName".
+func SchemaFieldPaths(schemaJSON string) ([]string, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(schemaJSON), &raw); err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	var walk func(prefix string, fields []schemaField)
+	walk = func(prefix string, fields []schemaField) {
+		for _, f := range fields {
+			paths = append(paths, prefix+f.name)
+			walk(prefix+f.name+".", f.fields)
+		}
+	}
+	walk("", recordFields(raw, make(map[string][]schemaField)))
+
+	return paths, nil
+}
+
+// recordFields returns the fields of the record type t, or nil when t is not a record.
+// Named records are remembered so that later references by name can be resolved.
+func recordFields(t interface{}, named map[string][]schemaField) []schemaField {
+	switch v := t.(type) {
+	case string:
+		return named[v]
+	case []interface{}:
+		// union, e.g. ["null", {"type": "record", ...}]
+		for _, branch := range v {
+			if fields := recordFields(branch, named); fields != nil {
+				return fields
+			}
+		}
+	case map[string]interface{}:
+		if v["type"] != "record" {
+			return nil
+		}
+
+		rawFields, _ := v["fields"].([]interface{})
+		fields := make([]schemaField, 0, len(rawFields))
+		for _, rawField := range rawFields {
+			f, _ := rawField.(map[string]interface{})
+			name, _ := f["name"].(string)
+			fields = append(fields, schemaField{
+				name:   name,
+				fields: recordFields(f["type"], named),
+			})
+		}
+
+		if name, ok := v["name"].(string); ok {
+			named[name] = fields
+			if namespace, ok := v["namespace"].(string); ok {
+				named[namespace+"."+name] = fields
+			}
+		}
+
+		return fields
+	}
+
+	return nil
+}
+
+// decodeBitmaps translates the bitmap fields of a change event header into field paths.
+// Each bitmap is either a hex string whose bits are positions of the top level fields, e.g. "0x2A",
+// or a position followed by a hex string whose bits are positions of the fields of that compound field,
+// e.g. "3-0x01" for Name.FirstName.
+func (s *schema) decodeBitmaps(bitmaps []string) ([]string, error) {
+	var paths []string
+	for _, bitmap := range bitmaps {
+		fields := s.fields
+		prefix := ""
+
+		if parent, nested, ok := strings.Cut(bitmap, "-"); ok {
+			i, err := strconv.Atoi(parent)
+			if err != nil || i < 0 || i >= len(s.fields) {
+				return nil, fmt.Errorf("invalid field bitmap %q", bitmap)
+			}
+
+			fields = s.fields[i].fields
+			prefix = s.fields[i].name + "."
+			bitmap = nested
+		}
+
+		positions, err := bitmapPositions(bitmap)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, i := range positions {
+			if i >= len(fields) {
+				return nil, fmt.Errorf("field position %d of bitmap %q is out of range", i, bitmap)
+			}
+			paths = append(paths, prefix+fields[i].name)
+		}
+	}
+
+	return paths, nil
+}
+
+// bitmapPositions returns the positions of the bits set in the hex bitmap, lowest first.
+func bitmapPositions(bitmap string) ([]int, error) {
+	n, ok := new(big.Int).SetString(strings.TrimPrefix(bitmap, "0x"), 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid field bitmap %q", bitmap)
+	}
+
+	var positions []int
+	for i := 0; i < n.BitLen(); i++ {
+		if n.Bit(i) == 1 {
+			positions = append(positions, i)
+		}
+	}
+
+	return positions, nil
+}
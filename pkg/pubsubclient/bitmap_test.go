@@ -0,0 +1,99 @@
+package pubsubclient
+
+import (
+	"reflect"
+	"testing"
+)
+
+const bitmapSchemaJSON = `{
+	"type": "record",
+	"name": "AccountChangeEvent",
+	"namespace": "com.sforce.eventbus",
+	"fields": [
+		{"name": "Id", "type": "string"},
+		{"name": "Name", "type": ["null", {
+			"type": "record",
+			"name": "Name",
+			"fields": [
+				{"name": "Salutation", "type": ["null", "string"], "default": null},
+				{"name": "FirstName", "type": ["null", "string"], "default": null},
+				{"name": "LastName", "type": ["null", "string"], "default": null}
+			]
+		}], "default": null},
+		{"name": "Industry", "type": ["null", "string"], "default": null},
+		{"name": "ShippingName", "type": ["null", "Name"], "default": null}
+	]
+}`
+
+func TestBitmapPositions(t *testing.T) {
+	tests := []struct {
+		bitmap  string
+		want    []int
+		wantErr bool
+	}{
+		{bitmap: "0x0", want: nil},
+		{bitmap: "0x1", want: []int{0}},
+		{bitmap: "0x2A", want: []int{1, 3, 5}},
+		{bitmap: "0x8000", want: []int{15}},
+		// wider than 64 bits
+		{bitmap: "0x100000000000000000001", want: []int{0, 80}},
+		{bitmap: "2A", want: []int{1, 3, 5}},
+		{bitmap: "0x", wantErr: true},
+		{bitmap: "0xZZ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.bitmap, func(t *testing.T) {
+			got, err := bitmapPositions(tt.bitmap)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bitmapPositions(%q) error = %v, wantErr %v", tt.bitmap, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("bitmapPositions(%q) = %v, want %v", tt.bitmap, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeBitmaps(t *testing.T) {
+	s, err := newSchema(bitmapSchemaJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		bitmaps []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "no bitmaps", bitmaps: nil, want: nil},
+		{name: "lowest bit is the first field", bitmaps: []string{"0x1"}, want: []string{"Id"}},
+		{name: "fields in schema order", bitmaps: []string{"0x6"}, want: []string{"Name", "Industry"}},
+		{name: "nested field", bitmaps: []string{"1-0x2"}, want: []string{"Name.FirstName"}},
+		{name: "nested fields", bitmaps: []string{"1-0x5"}, want: []string{"Name.Salutation", "Name.LastName"}},
+		{name: "named record reference", bitmaps: []string{"3-0x4"}, want: []string{"ShippingName.LastName"}},
+		{
+			name:    "top level and nested bitmaps",
+			bitmaps: []string{"0x4", "1-0x4"},
+			want:    []string{"Industry", "Name.LastName"},
+		},
+		{name: "position out of range", bitmaps: []string{"0x10"}, wantErr: true},
+		{name: "nested position out of range", bitmaps: []string{"1-0x8"}, wantErr: true},
+		{name: "parent out of range", bitmaps: []string{"4-0x1"}, wantErr: true},
+		{name: "invalid parent", bitmaps: []string{"x-0x1"}, wantErr: true},
+		{name: "invalid bitmap", bitmaps: []string{"0xZZ"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.decodeBitmaps(tt.bitmaps)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeBitmaps(%q) error = %v, wantErr %v", tt.bitmaps, err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("decodeBitmaps(%q) = %q, want %q", tt.bitmaps, got, tt.want)
+			}
+		})
+	}
+}
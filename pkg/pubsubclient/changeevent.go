@@ -0,0 +1,181 @@
+package pubsubclient
+
+import (
+	"strings"
+	"time"
+)
+
+// ChangeEventHeaderField is the field of the ChangeEventHeader in the payload of a change event.
+const ChangeEventHeaderField = "ChangeEventHeader"
+
+// Change types of the ChangeEventHeader. Gap events, e.g. GAP_UPDATE, only carry the header and are sent
+// when the change can't be delivered with its fields; GAP_OVERFLOW is sent instead of the events of a
+// transaction that changed too many records.
+const (
+	ChangeTypeCreate      = "CREATE"
+	ChangeTypeUpdate      = "UPDATE"
+	ChangeTypeDelete      = "DELETE"
+	ChangeTypeUndelete    = "UNDELETE"
+	ChangeTypeGapOverflow = "GAP_OVERFLOW"
+
+	gapChangeTypePrefix = "GAP_"
+)
+
+// ChangeEventHeader is the header carried by every change data capture event.
+type ChangeEventHeader struct {
+	EntityName      string
+	RecordIDs       []string
+	ChangeType      string
+	ChangeOrigin    string
+	TransactionKey  string
+	SequenceNumber  int64
+	CommitTimestamp time.Time
+	CommitNumber    int64
+	CommitUser      string
+	NulledFields    []string
+	DiffFields      []string
+	ChangedFields   []string
+}
+
+// ChangeEventHeader returns the header of a change data capture event,
+// or false when the event is not a change event, e.g. a platform event.
+func (e Event) ChangeEventHeader() (ChangeEventHeader, bool) {
+	raw, ok := unwrapUnion(e.Body[ChangeEventHeaderField]).(map[string]interface{})
+	if !ok {
+		return ChangeEventHeader{}, false
+	}
+
+	header := ChangeEventHeader{
+		EntityName:     stringValue(raw["entityName"]),
+		RecordIDs:      stringsValue(raw["recordIds"]),
+		ChangeType:     stringValue(raw["changeType"]),
+		ChangeOrigin:   stringValue(raw["changeOrigin"]),
+		TransactionKey: stringValue(raw["transactionKey"]),
+		SequenceNumber: int64Value(raw["sequenceNumber"]),
+		CommitNumber:   int64Value(raw["commitNumber"]),
+		CommitUser:     stringValue(raw["commitUser"]),
+		NulledFields:   stringsValue(raw["nulledFields"]),
+		DiffFields:     stringsValue(raw["diffFields"]),
+		ChangedFields:  stringsValue(raw["changedFields"]),
+	}
+	if ts := int64Value(raw["commitTimestamp"]); ts > 0 {
+		header.CommitTimestamp = time.UnixMilli(ts)
+	}
+
+	return header, true
+}
+
+// IsGap reports whether the event is a gap event, including GAP_OVERFLOW.
+func (h ChangeEventHeader) IsGap() bool {
+	return strings.HasPrefix(h.ChangeType, gapChangeTypePrefix)
+}
+
+// Fields returns the fields of the event without the ChangeEventHeader, with the Avro unions unwrapped,
+// e.g. {"Name": {"string": "Acme"}} becomes {"Name": "Acme"}. Fields that are not set are nil.
+func (e Event) Fields() map[string]interface{} {
+	fields := make(map[string]interface{}, len(e.Body))
+	for name, value := range e.Body {
+		if name != ChangeEventHeaderField {
+			fields[name] = unwrapValue(value)
+		}
+	}
+
+	return fields
+}
+
+func unwrapValue(v interface{}) interface{} {
+	switch value := unwrapUnion(v).(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for name, field := range value {
+			result[name] = unwrapValue(field)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			result = append(result, unwrapValue(item))
+		}
+		return result
+	default:
+		return value
+	}
+}
+
+// unwrapUnion returns the value of an Avro union, which goavro decodes as a map
+// with the name of the branch as the only key, e.g. {"string": "foo"}.
+func unwrapUnion(v interface{}) interface{} {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return v
+	}
+
+	for branch, value := range m {
+		switch branch {
+		case "string", "int", "long", "float", "double", "boolean", "bytes", "array", "map":
+			return value
+		}
+		if _, ok := value.(map[string]interface{}); ok {
+			// a named record, e.g. {"com.sforce.eventbus.Address": {...}}
+			return value
+		}
+	}
+
+	return v
+}
+
+func stringValue(v interface{}) string {
+	s, _ := unwrapUnion(v).(string)
+	return s
+}
+
+func int64Value(v interface{}) int64 {
+	switch n := unwrapUnion(v).(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	case float64:
+		return int64(n)
+	}
+
+	return 0
+}
+
+func stringsValue(v interface{}) []string {
+	values, ok := unwrapUnion(v).([]interface{})
+	if !ok {
+		return nil
+	}
+
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		result = append(result, stringValue(value))
+	}
+
+	return result
+}
+
+// decodeChangeEventFields sets the changed, nulled and diff fields of the event
+// from the bitmaps of its ChangeEventHeader.
+func (s *schema) decodeChangeEventFields(event *Event) error {
+	header, ok := event.ChangeEventHeader()
+	if !ok {
+		return nil
+	}
+
+	var err error
+	if event.ChangedFields, err = s.decodeBitmaps(header.ChangedFields); err != nil {
+		return err
+	}
+	if event.NulledFields, err = s.decodeBitmaps(header.NulledFields); err != nil {
+		return err
+	}
+	if event.DiffFields, err = s.decodeBitmaps(header.DiffFields); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package pubsubclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// number of times the handler is called for an event before it is dead-lettered
+	handleAttempts = 3
+	// delay before calling the handler again, multiplied by the number of attempts
+	handleRetryDelay = 200 * time.Millisecond
+)
+
+// ErrDecode is returned when the payload of an event can't be decoded with its schema.
+var ErrDecode = errors.New("failed to decode event")
+
+type (
+	// RawEvent is an event as received from Salesforce, before it is decoded.
+	RawEvent struct {
+		OrgID     string
+		TopicName string
+		ReplayID  []byte
+		SchemaID  string
+		Payload   []byte
+	}
+
+	// DeadLetter is an event that could not be decoded or handled.
+	DeadLetter struct {
+		RawEvent
+		Error    string
+		Attempts int
+	}
+
+	// DeadLetterQueue stores the events that could not be decoded or handled, so that the subscription
+	// continues with the next event instead of failing. The replay ID of a dead-lettered event is
+	// checkpointed once DeadLetter returns without an error.
+	DeadLetterQueue interface {
+		DeadLetter(ctx context.Context, letter DeadLetter) error
+	}
+)
+
+// Decode decodes the payload of the raw event with its schema, fetching the schema when it is not cached.
+// Errors of the payload itself wrap ErrDecode.
+func (p *PubSubClient) Decode(ctx context.Context, auth Auth, raw RawEvent) (Event, error) {
+	return p.decode(ctx, p.getAuthContext(ctx, auth), auth, raw)
+}
+
+func (p *PubSubClient) decode(ctx, authCtx context.Context, auth Auth, raw RawEvent) (Event, error) {
+	schema, err := p.fetchSchema(authCtx, auth, raw.SchemaID)
+	if err != nil {
+		p.logger.Error("failed to fetch codec", zap.Error(err))
+		return Event{}, err
+	}
+
+	p.registerSchema(ctx, raw.OrgID, raw.TopicName, raw.SchemaID, schema)
+
+	parsed, _, err := schema.codec.NativeFromBinary(raw.Payload)
+	if err != nil {
+		p.logger.Error("failed to parse event", zap.Error(err))
+		return Event{}, fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+
+	body, ok := parsed.(map[string]interface{})
+	if !ok {
+		return Event{}, fmt.Errorf("%w: error casting parsed event: %v", ErrDecode, parsed)
+	}
+
+	p.logger.Info("event body", zap.Any("body", body))
+
+	decoded := Event{
+		OrgID:     raw.OrgID,
+		TopicName: raw.TopicName,
+		ReplayID:  raw.ReplayID,
+		SchemaID:  raw.SchemaID,
+		Body:      body,
+	}
+	if err := schema.decodeChangeEventFields(&decoded); err != nil {
+		p.logger.Warn("failed to decode field bitmaps", zap.Error(err))
+	}
+
+	return decoded, nil
+}
+
+// handleWithRetry calls the handler until it succeeds or fails handleAttempts times,
+// and returns the number of attempts with the last error.
+func handleWithRetry(ctx context.Context, handler EventHandler, event Event) (int, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = handler.HandleEvent(ctx, event); err == nil || attempt >= handleAttempts {
+			return attempt, err
+		}
+
+		timer := time.NewTimer(time.Duration(attempt) * handleRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package pubsubclient
+
+import "context"
+
+type (
+	// Event is a decoded event received from a subscription. For change events, the bitmap fields
+	// of the ChangeEventHeader are decoded into field paths, e.g. "Name.FirstName".
+	Event struct {
+		OrgID         string
+		TopicName     string
+		ReplayID      []byte
+		SchemaID      string
+		Body          map[string]interface{}
+		ChangedFields []string
+		NulledFields  []string
+		DiffFields    []string
+	}
+
+	// EventHandler receives every decoded event of a subscription. The replay ID of the event
+	// is only checkpointed once HandleEvent returns without an error.
+	EventHandler interface {
+		HandleEvent(ctx context.Context, event Event) error
+	}
+
+	EventHandlerFunc func(ctx context.Context, event Event) error
+)
+
+func (f EventHandlerFunc) HandleEvent(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
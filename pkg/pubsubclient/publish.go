@@ -0,0 +1,300 @@
+package pubsubclient
+
+import (
+	"context"
+	"fmt"
+	"github/michaellimmm/salesforce-app-example/gen/pubsubapi"
+	"io"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/linkedin/goavro/v2"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type (
+	// PublishResult is the outcome of publishing a single event. CorrelationKey is the ID
+	// assigned to the event when it was sent; Err is a *PublishError when Salesforce rejected it.
+	PublishResult struct {
+		ReplayID       []byte
+		CorrelationKey string
+		Err            error
+	}
+
+	PublishError struct {
+		Code           pubsubapi.ErrorCode
+		Msg            string
+		CorrelationKey string
+	}
+
+	// Publisher publishes events to a topic over a single PublishStream call.
+	// Results are acknowledged asynchronously by Salesforce and delivered on Results.
+	// The results are queued until they are read, so that a caller that publishes
+	// before reading the results never blocks the stream.
+	Publisher struct {
+		logger    *zap.Logger
+		ctx       context.Context
+		stream    pubsubapi.PubSub_PublishStreamClient
+		topicName string
+		schemaID  string
+		codec     *goavro.Codec
+		results   chan PublishResult
+		done      chan struct{}
+		mutex     sync.Mutex
+		err       error
+		// pending holds the results received but not yet delivered on results
+		pending    []PublishResult
+		received   bool
+		queueMutex sync.Mutex
+		queue      *sync.Cond
+	}
+)
+
+func (e *PublishError) Error() string {
+	return fmt.Sprintf("failed to publish event %s: %s: %s", e.CorrelationKey, e.Code, e.Msg)
+}
+
+// Publish Avro-encodes the events with the schema of the topic and publishes them in a single request.
+func (p *PubSubClient) Publish(
+	ctx context.Context,
+	auth Auth,
+	topicName string,
+	events []map[string]interface{}) ([]PublishResult, error) {
+	var trailer metadata.MD
+
+	schemaID, codec, err := p.fetchTopicCodec(ctx, auth, topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := newPublishRequest(topicName, schemaID, codec, events)
+	if err != nil {
+		return nil, err
+	}
+
+	newCtx := p.getAuthContext(ctx, auth)
+	resp, err := p.pubSubClient.Publish(newCtx, req, grpc.Trailer(&trailer))
+	if err != nil {
+		p.logger.Error("failed to publish", zap.Error(err))
+		return nil, err
+	}
+
+	return toPublishResults(resp), nil
+}
+
+// PublishStream opens a stream to publish events to the topic. The caller must Close the publisher,
+// which returns once all results have been received, and then read the remaining Results until the
+// channel is closed. The results that are not read are dropped when ctx is done.
+func (p *PubSubClient) PublishStream(ctx context.Context, auth Auth, topicName string) (*Publisher, error) {
+	schemaID, codec, err := p.fetchTopicCodec(ctx, auth, topicName)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := p.pubSubClient.PublishStream(p.getAuthContext(ctx, auth))
+	if err != nil {
+		p.logger.Error("failed to open publish stream", zap.Error(err))
+		return nil, err
+	}
+
+	return newPublisher(ctx, p.logger, stream, topicName, schemaID, codec), nil
+}
+
+func newPublisher(
+	ctx context.Context,
+	logger *zap.Logger,
+	stream pubsubapi.PubSub_PublishStreamClient,
+	topicName, schemaID string,
+	codec *goavro.Codec) *Publisher {
+	publisher := &Publisher{
+		logger:    logger,
+		ctx:       ctx,
+		stream:    stream,
+		topicName: topicName,
+		schemaID:  schemaID,
+		codec:     codec,
+		results:   make(chan PublishResult, appetite),
+		done:      make(chan struct{}),
+	}
+	publisher.queue = sync.NewCond(&publisher.queueMutex)
+	go publisher.receive()
+	go publisher.deliver()
+
+	return publisher
+}
+
+// Publish sends the events and returns the correlation keys that their results will carry.
+func (pub *Publisher) Publish(events []map[string]interface{}) ([]string, error) {
+	req, err := newPublishRequest(pub.topicName, pub.schemaID, pub.codec, events)
+	if err != nil {
+		return nil, err
+	}
+
+	pub.mutex.Lock()
+	defer pub.mutex.Unlock()
+
+	if err := pub.stream.Send(req); err != nil {
+		if err == io.EOF {
+			// the actual error is returned by Recv
+			<-pub.done
+			return nil, pub.Err()
+		}
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(req.Events))
+	for _, event := range req.Events {
+		keys = append(keys, event.Id)
+	}
+
+	return keys, nil
+}
+
+func (pub *Publisher) Results() <-chan PublishResult {
+	return pub.results
+}
+
+// Err returns the error that closed the stream, if any, once all results have been received.
+func (pub *Publisher) Err() error {
+	select {
+	case <-pub.done:
+		return pub.err
+	default:
+		return nil
+	}
+}
+
+// Close tells Salesforce that no more events will be sent and waits until the remaining results are received.
+func (pub *Publisher) Close() error {
+	pub.mutex.Lock()
+	err := pub.stream.CloseSend()
+	pub.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	<-pub.done
+	return pub.err
+}
+
+// receive queues the results of the stream until it ends. It never waits for the results to be read,
+// so that Publish and Close are not blocked by a caller that reads the results later.
+func (pub *Publisher) receive() {
+	defer func() {
+		pub.queueMutex.Lock()
+		pub.received = true
+		pub.queue.Signal()
+		pub.queueMutex.Unlock()
+	}()
+	defer close(pub.done)
+
+	for {
+		resp, err := pub.stream.Recv()
+		if err == io.EOF {
+			return
+		} else if err != nil {
+			pub.logger.Error("failed to receive publish response", zap.Error(err))
+			pub.err = err
+			return
+		}
+
+		pub.queueMutex.Lock()
+		pub.pending = append(pub.pending, toPublishResults(resp)...)
+		pub.queue.Signal()
+		pub.queueMutex.Unlock()
+	}
+}
+
+// deliver sends the queued results on Results and closes it once all of them have been read,
+// or drops them when the context of the stream is done.
+func (pub *Publisher) deliver() {
+	defer close(pub.results)
+
+	for {
+		pub.queueMutex.Lock()
+		for len(pub.pending) == 0 && !pub.received {
+			pub.queue.Wait()
+		}
+		if len(pub.pending) == 0 {
+			pub.queueMutex.Unlock()
+			return
+		}
+		result := pub.pending[0]
+		pub.pending = pub.pending[1:]
+		pub.queueMutex.Unlock()
+
+		select {
+		case pub.results <- result:
+		case <-pub.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *PubSubClient) fetchTopicCodec(ctx context.Context, auth Auth, topicName string) (string, *goavro.Codec, error) {
+	topic, err := p.GetTopic(ctx, auth, topicName)
+	if err != nil {
+		p.logger.Error("failed to get topic", zap.Error(err))
+		return "", nil, err
+	}
+
+	if !topic.GetCanPublish() {
+		return "", nil, fmt.Errorf("topic %s can not be published", topicName)
+	}
+
+	codec, err := p.fetchCodec(ctx, auth, topic.GetSchemaId())
+	if err != nil {
+		p.logger.Error("failed to fetch codec", zap.Error(err))
+		return "", nil, err
+	}
+
+	return topic.GetSchemaId(), codec, nil
+}
+
+func newPublishRequest(
+	topicName, schemaID string,
+	codec *goavro.Codec,
+	events []map[string]interface{}) (*pubsubapi.PublishRequest, error) {
+	req := &pubsubapi.PublishRequest{
+		TopicName: topicName,
+		Events:    make([]*pubsubapi.ProducerEvent, 0, len(events)),
+	}
+
+	for _, event := range events {
+		payload, err := codec.BinaryFromNative(nil, event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode event: %w", err)
+		}
+
+		req.Events = append(req.Events, &pubsubapi.ProducerEvent{
+			Id:       uuid.NewString(),
+			SchemaId: schemaID,
+			Payload:  payload,
+		})
+	}
+
+	return req, nil
+}
+
+func toPublishResults(resp *pubsubapi.PublishResponse) []PublishResult {
+	results := make([]PublishResult, 0, len(resp.GetResults()))
+	for _, result := range resp.GetResults() {
+		res := PublishResult{
+			ReplayID:       result.GetReplayId(),
+			CorrelationKey: result.GetCorrelationKey(),
+		}
+		if result.GetError() != nil {
+			res.Err = &PublishError{
+				Code:           result.GetError().GetCode(),
+				Msg:            result.GetError().GetMsg(),
+				CorrelationKey: result.GetCorrelationKey(),
+			}
+		}
+
+		results = append(results, res)
+	}
+
+	return results
+}
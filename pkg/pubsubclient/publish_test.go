@@ -0,0 +1,84 @@
+package pubsubclient
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/gen/pubsubapi"
+	"io"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+// fakePublishStream answers every request with one response per event and ends the stream on CloseSend.
+type fakePublishStream struct {
+	grpc.ClientStream
+	responses chan *pubsubapi.PublishResponse
+}
+
+func (f *fakePublishStream) Send(req *pubsubapi.PublishRequest) error {
+	for _, event := range req.Events {
+		f.responses <- &pubsubapi.PublishResponse{
+			Results: []*pubsubapi.PublishResult{{ReplayId: []byte{1}, CorrelationKey: event.Id}},
+		}
+	}
+
+	return nil
+}
+
+func (f *fakePublishStream) Recv() (*pubsubapi.PublishResponse, error) {
+	resp, ok := <-f.responses
+	if !ok {
+		return nil, io.EOF
+	}
+
+	return resp, nil
+}
+
+func (f *fakePublishStream) CloseSend() error {
+	close(f.responses)
+	return nil
+}
+
+func TestPublisherCloseBeforeReadingResults(t *testing.T) {
+	const events = 4 * appetite
+
+	schema, err := newSchema(benchSchemaJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := &fakePublishStream{responses: make(chan *pubsubapi.PublishResponse, events)}
+	pub := newPublisher(context.Background(), zap.NewNop(), stream, "/event/Bench__e", "bench", schema.codec)
+
+	keys := make(map[string]bool)
+	for i := 0; i < int(events); i++ {
+		published, err := pub.Publish([]map[string]interface{}{{"Name": "bench"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[published[0]] = true
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- pub.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked on the results that were not read")
+	}
+
+	for result := range pub.Results() {
+		if !keys[result.CorrelationKey] {
+			t.Fatalf("unexpected result %s", result.CorrelationKey)
+		}
+		delete(keys, result.CorrelationKey)
+	}
+	if len(keys) > 0 {
+		t.Fatalf("%d results were not delivered", len(keys))
+	}
+}
@@ -3,17 +3,22 @@ package pubsubclient
 import (
 	"context"
 	"crypto/x509"
-	"fmt"
+	"errors"
 	"github/michaellimmm/salesforce-app-example/gen/pubsubapi"
 	"io"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/linkedin/goavro/v2"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -22,6 +27,21 @@ const (
 	tokenHeader    = "accesstoken"
 	instanceHeader = "instanceurl"
 	tenantHeader   = "tenantid"
+
+	// timeout of a schema fetch shared by all subscriptions waiting for the same schema
+	schemaFetchTimeout = 30 * time.Second
+	// how long LatestReplayID waits for the first response, which only comes with the next event or
+	// keepalive of the server
+	latestReplayIDTimeout = 10 * time.Second
+)
+
+var (
+	// ErrInvalidReplayID is returned by Subscribe when Salesforce rejects the custom
+	// replay ID, e.g. because it is older than the event retention window.
+	ErrInvalidReplayID = errors.New("replay id is invalid or expired")
+	// ErrReplayIDUnavailable is returned by LatestReplayID when the position of the topic is not known,
+	// e.g. no event has been published to it or the server didn't respond in time.
+	ErrReplayIDUnavailable = errors.New("latest replay id is not available")
 )
 
 type (
@@ -29,8 +49,20 @@ type (
 		logger       *zap.Logger
 		conn         *grpc.ClientConn
 		pubSubClient pubsubapi.PubSubClient
-		schemaCache  map[string]*goavro.Codec
-		mutex        sync.Mutex
+		schemaCache  map[string]*schema
+		schemaGroup  singleflight.Group
+		mutex        sync.RWMutex
+		registry     SchemaRegistry
+		registered   map[string]struct{}
+	}
+
+	Option func(p *PubSubClient)
+
+	// SchemaRegistry stores the schemas seen by the client, so that the schema cache survives restarts
+	// and the schema versions of every topic can be tracked.
+	SchemaRegistry interface {
+		LoadSchemas(ctx context.Context) (map[string]string, error)
+		RegisterSchema(ctx context.Context, orgID, topicName, schemaID, schemaJSON string) error
 	}
 
 	Auth struct {
@@ -38,9 +70,25 @@ type (
 		InstanceUrl string
 		OrgID       string
 	}
+
+	SubscribeRequest struct {
+		TopicName    string
+		ReplayPreset pubsubapi.ReplayPreset
+		ReplayID     []byte
+		Checkpointer Checkpointer
+		Handler      EventHandler
+		FlowControl  FlowControl
+		DeadLetters  DeadLetterQueue
+	}
+
+	// Checkpointer persists the replay ID of every event that has been processed,
+	// so that the subscription can be resumed from there.
+	Checkpointer interface {
+		SaveReplayID(ctx context.Context, orgID, topicName string, replayID []byte) error
+	}
 )
 
-func NewPubSubClient(logger *zap.Logger) *PubSubClient {
+func NewPubSubClient(logger *zap.Logger, opts ...Option) *PubSubClient {
 	dialOpts := []grpc.DialOption{}
 
 	grpcEndpoint := os.Getenv("SALESFORCE_GRPC_ENDPOINT")
@@ -53,12 +101,52 @@ func NewPubSubClient(logger *zap.Logger) *PubSubClient {
 		logger.Fatal("failed to connect salesforce", zap.Error(err))
 	}
 
-	return &PubSubClient{
+	p := &PubSubClient{
 		logger:       logger,
 		conn:         conn,
 		pubSubClient: pubsubapi.NewPubSubClient(conn),
-		schemaCache:  make(map[string]*goavro.Codec),
+		schemaCache:  make(map[string]*schema),
+		registered:   make(map[string]struct{}),
+	}
+	for _, o := range opts {
+		o(p)
+	}
+
+	return p
+}
+
+func WithSchemaRegistry(registry SchemaRegistry) Option {
+	return func(p *PubSubClient) {
+		p.registry = registry
+	}
+}
+
+// WarmSchemaCache loads the schemas stored in the registry into the schema cache.
+func (p *PubSubClient) WarmSchemaCache(ctx context.Context) error {
+	if p.registry == nil {
+		return nil
+	}
+
+	schemas, err := p.registry.LoadSchemas(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for schemaID, schemaJSON := range schemas {
+		cached, err := newSchema(schemaJSON)
+		if err != nil {
+			p.logger.Warn("failed to load schema", zap.String("schema_id", schemaID), zap.Error(err))
+			continue
+		}
+
+		p.schemaCache[schemaID] = cached
 	}
+
+	p.logger.Info("schema cache warmed", zap.Int("schemas", len(p.schemaCache)))
+	return nil
 }
 
 func getCerts() *x509.CertPool {
@@ -115,26 +203,26 @@ func (p *PubSubClient) GetSchema(
 func (p *PubSubClient) Subscribe(
 	ctx context.Context,
 	auth Auth,
-	topicName string,
-	replayPreset pubsubapi.ReplayPreset,
-	replayID []byte) ([]byte, error) {
+	req SubscribeRequest) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	newCtx := p.getAuthContext(ctx, auth)
-	// TODO: there's possiblity that access token is expired,
-	// so check if we need to get new token or not
 
 	subscribeClient, err := p.pubSubClient.Subscribe(newCtx)
 	if err != nil {
 		p.logger.Error("failed to subscribe", zap.Error(err))
-		return replayID, err
+		return req.ReplayID, err
 	}
 
+	flow := req.FlowControl.withDefaults()
 	initialFetchRequest := &pubsubapi.FetchRequest{
-		TopicName:    topicName,
-		ReplayPreset: replayPreset,
-		NumRequested: appetite,
+		TopicName:    req.TopicName,
+		ReplayPreset: req.ReplayPreset,
+		NumRequested: flow.NumRequested,
 	}
-	if replayPreset == pubsubapi.ReplayPreset_CUSTOM && replayID != nil {
-		initialFetchRequest.ReplayId = replayID
+	if req.ReplayPreset == pubsubapi.ReplayPreset_CUSTOM && req.ReplayID != nil {
+		initialFetchRequest.ReplayId = req.ReplayID
 	}
 
 	err = subscribeClient.Send(initialFetchRequest)
@@ -142,92 +230,188 @@ func (p *PubSubClient) Subscribe(
 		p.logger.Info("WARNING - EOF error returned from initial Send call, proceeding anyway")
 	} else if err != nil {
 		p.logger.Error("failed to fetch request", zap.Error(err))
-		return replayID, err
+		return req.ReplayID, err
 	}
 
-	requestedEvents := initialFetchRequest.NumRequested
+	handleCtx := context.WithoutCancel(ctx)
+	sub := &subscription{
+		client:      p,
+		ctx:         ctx,
+		handleCtx:   handleCtx,
+		authCtx:     p.getAuthContext(handleCtx, auth),
+		auth:        auth,
+		req:         req,
+		flow:        flow,
+		stream:      subscribeClient,
+		customStart: initialFetchRequest.ReplayId != nil,
+		replayID:    req.ReplayID,
+	}
 
-	// NOTE: the replayID should've stored in a persistent dadta store rather than being stored in a variable
-	curReplayID := replayID
-	for {
+	if flow.MaxInFlight > 0 {
+		err = sub.runAdaptive(initialFetchRequest.NumRequested)
+	} else {
+		err = sub.run(initialFetchRequest.NumRequested)
+	}
 
-		resp, err := subscribeClient.Recv()
-		if err == io.EOF {
-			return curReplayID, fmt.Errorf("stream closed")
-		} else if err != nil {
-			p.logger.Error("failed to receive event", zap.Error(err))
-			return curReplayID, err
-		}
+	return sub.replayID, err
+}
+
+// LatestReplayID returns the replay ID of the latest event of the topic, so that a subscription can later be
+// started from this position with the CUSTOM replay preset. It waits for the first response of a subscription
+// from LATEST, which only arrives with the next event or keepalive of the server, for latestReplayIDTimeout
+// and returns ErrReplayIDUnavailable when it doesn't arrive in time or carries no replay ID.
+func (p *PubSubClient) LatestReplayID(ctx context.Context, auth Auth, topicName string) ([]byte, error) {
+	timeoutCtx, cancel := context.WithTimeout(ctx, latestReplayIDTimeout)
+	defer cancel()
+
+	subscribeClient, err := p.pubSubClient.Subscribe(p.getAuthContext(timeoutCtx, auth))
+	if err != nil {
+		p.logger.Error("failed to subscribe", zap.Error(err))
+		return nil, err
+	}
+
+	err = subscribeClient.Send(&pubsubapi.FetchRequest{
+		TopicName:    topicName,
+		ReplayPreset: pubsubapi.ReplayPreset_LATEST,
+		NumRequested: 1,
+	})
+	if err != nil && err != io.EOF {
+		p.logger.Error("failed to fetch request", zap.Error(err))
+		return nil, err
+	}
 
-		for _, event := range resp.Events {
-			p.logger.Info("event", zap.Any("event", event))
-
-			codec, err := p.fetchCodec(newCtx, auth, event.GetEvent().GetSchemaId())
-			if err != nil {
-				p.logger.Error("failed to fetch codec", zap.Error(err))
-				return curReplayID, err
-			}
-
-			parsed, _, err := codec.NativeFromBinary(event.GetEvent().GetPayload())
-			if err != nil {
-				p.logger.Error("failed to parse event", zap.Error(err))
-				return curReplayID, err
-			}
-
-			body, ok := parsed.(map[string]interface{})
-			if !ok {
-				return curReplayID, fmt.Errorf("error casting parsed event: %v", body)
-			}
-
-			curReplayID = event.GetReplayId()
-
-			p.logger.Info("event body", zap.Any("body", body))
-
-			requestedEvents--
-			if requestedEvents < appetite {
-				fetchRequest := &pubsubapi.FetchRequest{
-					TopicName:    topicName,
-					NumRequested: appetite,
-				}
-
-				err = subscribeClient.Send(fetchRequest)
-				if err == io.EOF {
-					// If the Send call returns an EOF error then print log
-					p.logger.Info("Warning - EOF error returned for subsequent Send call, proceeding anyway")
-				} else if err != nil {
-					return curReplayID, err
-				}
-
-				requestedEvents += fetchRequest.NumRequested
-			}
+	resp, err := subscribeClient.Recv()
+	if err != nil {
+		if ctx.Err() == nil && errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) {
+			return nil, ErrReplayIDUnavailable
 		}
+
+		return nil, err
+	}
+
+	if len(resp.GetLatestReplayId()) == 0 {
+		return nil, ErrReplayIDUnavailable
+	}
+
+	return resp.GetLatestReplayId(), nil
+}
+
+// IsAuthError reports whether the call failed because the access token is invalid or expired.
+// The caller should refresh the token and retry.
+func IsAuthError(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
 	}
+
+	return st.Code() == codes.Unauthenticated
+}
+
+// IsPermanentError reports whether the call failed for a reason that is not expected to go away
+// by retrying, e.g. the topic does not exist or the user is not allowed to subscribe to it.
+func IsPermanentError(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+
+	switch st.Code() {
+	case codes.NotFound, codes.PermissionDenied, codes.InvalidArgument, codes.Unimplemented:
+		return true
+	}
+
+	return false
+}
+
+// isReplayIDError reports whether the stream was rejected because of the replay ID
+// sent in the initial fetch request.
+func isReplayIDError(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+
+	return st.Code() == codes.InvalidArgument &&
+		strings.Contains(strings.ToLower(st.Message()), "replay")
 }
 
 // Unexported helper function to retrieve the cached codec from the PubSubClient's schema cache. If the schema ID is not found in the cache
 // then a GetSchema call is made and the corresponding codec is cached for future use
 func (p *PubSubClient) fetchCodec(ctx context.Context, auth Auth, schemaId string) (*goavro.Codec, error) {
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
+	schema, err := p.fetchSchema(ctx, auth, schemaId)
+	if err != nil {
+		return nil, err
+	}
+
+	return schema.codec, nil
+}
 
-	codec, ok := p.schemaCache[schemaId]
+// fetchSchema returns the cached schema without blocking other readers. Concurrent fetches of the same
+// missing schema are coalesced into a single GetSchema call, which is not canceled when one of the callers
+// gives up, so that the other callers still get the schema.
+func (p *PubSubClient) fetchSchema(ctx context.Context, auth Auth, schemaId string) (*schema, error) {
+	p.mutex.RLock()
+	cached, ok := p.schemaCache[schemaId]
+	p.mutex.RUnlock()
 	if ok {
-		return codec, nil
+		return cached, nil
 	}
 
-	schema, err := p.GetSchema(ctx, auth, schemaId)
-	if err != nil {
-		return nil, err
+	ch := p.schemaGroup.DoChan(schemaId, func() (interface{}, error) {
+		fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), schemaFetchTimeout)
+		defer cancel()
+
+		res, err := p.GetSchema(fetchCtx, auth, schemaId)
+		if err != nil {
+			return nil, err
+		}
+
+		cached, err := newSchema(res.GetSchemaJson())
+		if err != nil {
+			return nil, err
+		}
+
+		p.mutex.Lock()
+		p.schemaCache[schemaId] = cached
+		p.mutex.Unlock()
+
+		return cached, nil
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+
+		return res.Val.(*schema), nil
 	}
+}
 
-	codec, err = goavro.NewCodec(schema.GetSchemaJson())
-	if err != nil {
-		return nil, err
+// registerSchema records the schema in the registry the first time it is seen for the topic of the org.
+func (p *PubSubClient) registerSchema(ctx context.Context, orgID, topicName, schemaID string, schema *schema) {
+	if p.registry == nil {
+		return
 	}
 
-	p.schemaCache[schemaId] = codec
+	key := orgID + topicName + schemaID
+	p.mutex.RLock()
+	_, ok := p.registered[key]
+	p.mutex.RUnlock()
+	if ok {
+		return
+	}
 
-	return codec, nil
+	if err := p.registry.RegisterSchema(ctx, orgID, topicName, schemaID, schema.json); err != nil {
+		p.logger.Warn("failed to register schema", zap.String("schema_id", schemaID), zap.Error(err))
+		return
+	}
+
+	p.mutex.Lock()
+	p.registered[key] = struct{}{}
+	p.mutex.Unlock()
 }
 
 func (p *PubSubClient) getAuthContext(ctx context.Context, auth Auth) context.Context {
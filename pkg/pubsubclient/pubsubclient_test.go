@@ -0,0 +1,107 @@
+package pubsubclient
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/gen/pubsubapi"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+const (
+	benchSchemaJSON = `{"type": "record", "name": "Bench", "fields": [{"name": "Name", "type": "string"}]}`
+	slowSchemaID    = "slow"
+	slowSchemaDelay = 20 * time.Millisecond
+	// number of concurrent callers of the slow schema
+	schemaCallers = 50
+)
+
+// fakePubSubClient answers GetSchema after slowSchemaDelay for slowSchemaID and immediately for other IDs.
+type fakePubSubClient struct {
+	pubsubapi.PubSubClient
+	mutex sync.Mutex
+	calls map[string]int
+}
+
+func (f *fakePubSubClient) GetSchema(
+	ctx context.Context,
+	in *pubsubapi.SchemaRequest,
+	opts ...grpc.CallOption) (*pubsubapi.SchemaInfo, error) {
+	f.mutex.Lock()
+	f.calls[in.GetSchemaId()]++
+	f.mutex.Unlock()
+
+	if in.GetSchemaId() == slowSchemaID {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(slowSchemaDelay):
+		}
+	}
+
+	return &pubsubapi.SchemaInfo{SchemaJson: benchSchemaJSON, SchemaId: in.GetSchemaId()}, nil
+}
+
+func (f *fakePubSubClient) callsOf(schemaID string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.calls[schemaID]
+}
+
+func BenchmarkFetchSchema(b *testing.B) {
+	ctx := context.Background()
+	cached, err := newSchema(benchSchemaJSON)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		fake := &fakePubSubClient{calls: make(map[string]int)}
+		p := &PubSubClient{
+			logger:       zap.NewNop(),
+			pubSubClient: fake,
+			schemaCache:  map[string]*schema{"cached": cached},
+			registered:   make(map[string]struct{}),
+		}
+
+		var failed atomic.Int32
+		var wg sync.WaitGroup
+		for c := 0; c < schemaCallers; c++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := p.fetchSchema(ctx, Auth{}, slowSchemaID); err != nil {
+					failed.Add(1)
+				}
+			}()
+		}
+
+		// the other schemas are returned while the slow schema is being fetched
+		startedAt := time.Now()
+		if _, err := p.fetchSchema(ctx, Auth{}, "cached"); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := p.fetchSchema(ctx, Auth{}, "other"); err != nil {
+			b.Fatal(err)
+		}
+		if elapsed := time.Since(startedAt); elapsed >= slowSchemaDelay {
+			b.Fatalf("other schemas blocked behind the slow schema for %s", elapsed)
+		}
+
+		wg.Wait()
+		if n := failed.Load(); n > 0 {
+			b.Fatalf("%d callers failed to fetch the slow schema", n)
+		}
+		if n := fake.callsOf(slowSchemaID); n != 1 {
+			b.Fatalf("GetSchema called %d times for %d concurrent callers, want 1", n, schemaCallers)
+		}
+		if n := fake.callsOf("cached"); n != 0 {
+			b.Fatalf("GetSchema called %d times for a cached schema, want 0", n)
+		}
+	}
+}
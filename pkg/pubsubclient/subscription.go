@@ -0,0 +1,244 @@
+package pubsubclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github/michaellimmm/salesforce-app-example/gen/pubsubapi"
+	"io"
+
+	"go.uber.org/zap"
+)
+
+type (
+	// FlowControl controls how many events are requested from Salesforce.
+	FlowControl struct {
+		// NumRequested is the number of events asked for in every fetch request, 5 by default.
+		NumRequested int32
+		// MaxInFlight enables the adaptive mode when set: events are queued for the handler, and
+		// more events are only requested while fewer than MaxInFlight events are requested or queued,
+		// so that a slow handler slows down the subscription instead of growing the queue.
+		MaxInFlight int
+	}
+
+	// subscription is the state of a single Subscribe stream. Events are handled with handleCtx, which is
+	// not canceled with ctx, so that the events already received are drained when the subscription stops.
+	subscription struct {
+		client      *PubSubClient
+		ctx         context.Context
+		handleCtx   context.Context
+		authCtx     context.Context
+		auth        Auth
+		req         SubscribeRequest
+		flow        FlowControl
+		stream      pubsubapi.PubSub_SubscribeClient
+		customStart bool
+		received    bool
+		replayID    []byte
+	}
+)
+
+func (f FlowControl) withDefaults() FlowControl {
+	if f.NumRequested <= 0 {
+		f.NumRequested = appetite
+	}
+
+	if f.MaxInFlight > 0 && int(f.NumRequested) > f.MaxInFlight {
+		f.NumRequested = int32(f.MaxInFlight)
+	}
+
+	return f
+}
+
+// run receives and handles the events one by one, requesting more events
+// as soon as fewer than NumRequested are outstanding. Once ctx is done, the rest of
+// the received batch is handled without requesting more events.
+func (s *subscription) run(requestedEvents int32) error {
+	for {
+		resp, err := s.recv()
+		if err != nil {
+			return err
+		}
+
+		for _, event := range resp.Events {
+			if err := s.handle(event); err != nil {
+				return err
+			}
+
+			requestedEvents--
+			if s.ctx.Err() == nil && requestedEvents < s.flow.NumRequested {
+				if err := s.fetch(s.flow.NumRequested); err != nil {
+					return err
+				}
+
+				requestedEvents += s.flow.NumRequested
+			}
+		}
+	}
+}
+
+// runAdaptive receives the events in the background into a queue bounded by MaxInFlight and handles them
+// in the calling goroutine, which is also the only one sending fetch requests once the stream is started.
+// When the stream ends, e.g. because ctx is done, the queued events are handled before returning.
+func (s *subscription) runAdaptive(pending int32) error {
+	queue := make(chan *pubsubapi.ConsumerEvent, s.flow.MaxInFlight)
+	recvErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for {
+			resp, err := s.recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			for _, event := range resp.Events {
+				select {
+				case queue <- event:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case err := <-recvErr:
+			return s.drain(queue, err)
+		case event := <-queue:
+			if err := s.handle(event); err != nil {
+				return err
+			}
+
+			pending--
+			if s.ctx.Err() != nil {
+				continue
+			}
+
+			if capacity := int32(s.flow.MaxInFlight) - pending; capacity >= s.flow.NumRequested {
+				if err := s.fetch(capacity); err != nil {
+					return err
+				}
+
+				pending += capacity
+			}
+		}
+	}
+}
+
+// drain handles the queued events and returns the error that ended the stream.
+func (s *subscription) drain(queue chan *pubsubapi.ConsumerEvent, streamErr error) error {
+	for {
+		select {
+		case event := <-queue:
+			if err := s.handle(event); err != nil {
+				return err
+			}
+		default:
+			return streamErr
+		}
+	}
+}
+
+func (s *subscription) recv() (*pubsubapi.FetchResponse, error) {
+	resp, err := s.stream.Recv()
+	if err == io.EOF {
+		return nil, fmt.Errorf("stream closed")
+	} else if err != nil {
+		s.client.logger.Error("failed to receive event", zap.Error(err))
+		if !s.received && s.customStart && isReplayIDError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidReplayID, err)
+		}
+		return nil, err
+	}
+
+	s.received = true
+	return resp, nil
+}
+
+func (s *subscription) fetch(numRequested int32) error {
+	fetchRequest := &pubsubapi.FetchRequest{
+		TopicName:    s.req.TopicName,
+		NumRequested: numRequested,
+	}
+
+	err := s.stream.Send(fetchRequest)
+	if err == io.EOF {
+		// If the Send call returns an EOF error then print log
+		s.client.logger.Info("Warning - EOF error returned for subsequent Send call, proceeding anyway")
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// handle decodes the event, passes it to the handler and checkpoints its replay ID. With a dead letter
+// queue, an event that can't be decoded or handled is dead-lettered and checkpointed instead.
+func (s *subscription) handle(event *pubsubapi.ConsumerEvent) error {
+	p := s.client
+	p.logger.Info("event", zap.Any("event", event))
+
+	raw := RawEvent{
+		OrgID:     s.auth.OrgID,
+		TopicName: s.req.TopicName,
+		ReplayID:  event.GetReplayId(),
+		SchemaID:  event.GetEvent().GetSchemaId(),
+		Payload:   event.GetEvent().GetPayload(),
+	}
+
+	decoded, err := p.decode(s.handleCtx, s.authCtx, s.auth, raw)
+	switch {
+	case errors.Is(err, ErrDecode) && s.req.DeadLetters != nil:
+		if err := s.deadLetter(raw, err, 1); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case s.req.Handler != nil && s.req.DeadLetters != nil:
+		if attempts, err := handleWithRetry(s.handleCtx, s.req.Handler, decoded); err != nil {
+			if err := s.deadLetter(raw, err, attempts); err != nil {
+				return err
+			}
+		}
+	case s.req.Handler != nil:
+		if err := s.req.Handler.HandleEvent(s.handleCtx, decoded); err != nil {
+			p.logger.Error("failed to handle event", zap.Error(err))
+			return err
+		}
+	}
+
+	s.replayID = event.GetReplayId()
+	if s.req.Checkpointer != nil {
+		err := s.req.Checkpointer.SaveReplayID(s.handleCtx, s.auth.OrgID, s.req.TopicName, s.replayID)
+		if err != nil {
+			p.logger.Error("failed to save checkpoint", zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *subscription) deadLetter(raw RawEvent, cause error, attempts int) error {
+	s.client.logger.Warn("dead-lettering event",
+		zap.String("org_id", raw.OrgID),
+		zap.String("topic", raw.TopicName),
+		zap.Int("attempts", attempts),
+		zap.Error(cause))
+
+	err := s.req.DeadLetters.DeadLetter(s.handleCtx, DeadLetter{
+		RawEvent: raw,
+		Error:    cause.Error(),
+		Attempts: attempts,
+	})
+	if err != nil {
+		s.client.logger.Error("failed to dead-letter event", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package restclient
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// ResponseError is returned when Salesforce responds with an error status.
+type ResponseError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("salesforce responded with %d: %s", e.StatusCode, e.Body)
+}
+
+// IsUnauthorized reports whether the request failed because the access token is invalid or expired.
+func IsUnauthorized(err error) bool {
+	var respErr *ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusUnauthorized
+}
+
+// IsNotFound reports whether the request failed because the resource doesn't exist.
+func IsNotFound(err error) bool {
+	var respErr *ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+}
+
+func checkResponse(resp *resty.Response) error {
+	if !resp.IsError() {
+		return nil
+	}
+
+	return &ResponseError{
+		StatusCode: resp.StatusCode(),
+		Body:       string(resp.Body()),
+	}
+}
@@ -96,5 +96,9 @@ func (r *restClient) GetToken(ctx context.Context, param TokenRequest) (TokenRes
 		zap.Any("body", string(resp.Body())),
 		zap.String("response code", resp.Status()))
 
+	if err := checkResponse(resp); err != nil {
+		return TokenResponse{}, err
+	}
+
 	return result, nil
 }
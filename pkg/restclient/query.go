@@ -0,0 +1,110 @@
+package restclient
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.uber.org/zap"
+)
+
+const queryEndpoint = "/services/data/" + apiVersion + "/query"
+
+type Query interface {
+	Query(ctx context.Context, instanceUrl, accessToken, soql string, fn func(records []Record) error) error
+	QueryPage(ctx context.Context, instanceUrl, accessToken, soql, next string) ([]Record, string, error)
+}
+
+type (
+	// Record is a record returned by a SOQL query, without its attributes.
+	Record map[string]interface{}
+
+	queryResponse[T any] struct {
+		Done           bool   `json:"done"`
+		NextRecordsUrl string `json:"nextRecordsUrl"`
+		Records        []T    `json:"records"`
+	}
+)
+
+// Query runs the SOQL query and calls fn with every page of records, following nextRecordsUrl
+// until all pages are read or fn returns an error.
+func (r *restClient) Query(
+	ctx context.Context,
+	instanceUrl, accessToken, soql string,
+	fn func(records []Record) error) error {
+	q := make(url.Values)
+	q.Add("q", soql)
+
+	return queryPages(ctx, r, instanceUrl, accessToken, queryEndpoint+"?"+q.Encode(), func(records []Record) error {
+		for _, record := range records {
+			delete(record, "attributes")
+		}
+
+		return fn(records)
+	})
+}
+
+// QueryPage returns a page of records of the SOQL query and the URL of the next page, which is empty for
+// the last page. The first page is returned when next is empty, the following pages are read by passing
+// the URL of the previous page, e.g. after refreshing the access token.
+func (r *restClient) QueryPage(
+	ctx context.Context,
+	instanceUrl, accessToken, soql, next string) ([]Record, string, error) {
+	if next == "" {
+		q := make(url.Values)
+		q.Add("q", soql)
+		next = queryEndpoint + "?" + q.Encode()
+	}
+
+	result, err := queryPage[Record](ctx, r, instanceUrl, accessToken, next)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, record := range result.Records {
+		delete(record, "attributes")
+	}
+
+	return result.Records, result.NextRecordsUrl, nil
+}
+
+func queryPages[T any](
+	ctx context.Context,
+	r *restClient,
+	instanceUrl, accessToken, next string,
+	fn func(records []T) error) error {
+	for next != "" {
+		result, err := queryPage[T](ctx, r, instanceUrl, accessToken, next)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(result.Records); err != nil {
+			return err
+		}
+
+		next = result.NextRecordsUrl
+	}
+
+	return nil
+}
+
+func queryPage[T any](
+	ctx context.Context,
+	r *restClient,
+	instanceUrl, accessToken, next string) (queryResponse[T], error) {
+	result := queryResponse[T]{}
+	resp, err := r.client.R().SetContext(ctx).SetResult(&result).
+		SetHeader("Authorization", fmt.Sprintf("Bearer %s", accessToken)).
+		Get(instanceUrl + next)
+	if err != nil {
+		r.logger.Error("failed to query records", zap.Error(err))
+		return result, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
@@ -9,6 +9,9 @@ type (
 	RestClient interface {
 		OAuth
 		UserInfo
+		SObject
+		Query
+		Tooling
 	}
 
 	restClient struct {
@@ -0,0 +1,82 @@
+package restclient
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.uber.org/zap"
+)
+
+const (
+	apiVersion = "v59.0"
+
+	sobjectsEndpoint = "/services/data/" + apiVersion + "/sobjects"
+)
+
+type SObject interface {
+	DescribeGlobal(ctx context.Context, instanceUrl, accessToken string) (DescribeGlobalResponse, error)
+	DescribeSObject(ctx context.Context, instanceUrl, accessToken, name string) (DescribeSObjectResponse, error)
+}
+
+type (
+	DescribeGlobalResponse struct {
+		SObjects []SObjectDescribe `json:"sobjects"`
+	}
+
+	SObjectDescribe struct {
+		Name      string `json:"name"`
+		Label     string `json:"label"`
+		Custom    bool   `json:"custom"`
+		Queryable bool   `json:"queryable"`
+	}
+
+	DescribeSObjectResponse struct {
+		Name   string         `json:"name"`
+		Fields []SObjectField `json:"fields"`
+	}
+
+	SObjectField struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+		// CompoundFieldName is the compound field the field is part of, e.g. Name for FirstName
+		CompoundFieldName string `json:"compoundFieldName"`
+	}
+)
+
+func (r *restClient) DescribeGlobal(ctx context.Context, instanceUrl, accessToken string) (DescribeGlobalResponse, error) {
+	result := DescribeGlobalResponse{}
+	resp, err := r.client.R().SetContext(ctx).SetResult(&result).
+		SetHeader("Authorization", fmt.Sprintf("Bearer %s", accessToken)).
+		Get(instanceUrl + sobjectsEndpoint)
+	if err != nil {
+		r.logger.Error("failed to describe sobjects", zap.Error(err))
+		return DescribeGlobalResponse{}, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return DescribeGlobalResponse{}, err
+	}
+
+	return result, nil
+}
+
+// DescribeSObject returns the metadata of the object, e.g. Account, including its fields.
+func (r *restClient) DescribeSObject(
+	ctx context.Context,
+	instanceUrl, accessToken, name string) (DescribeSObjectResponse, error) {
+	result := DescribeSObjectResponse{}
+	resp, err := r.client.R().SetContext(ctx).SetResult(&result).
+		SetHeader("Authorization", fmt.Sprintf("Bearer %s", accessToken)).
+		Get(instanceUrl + sobjectsEndpoint + "/" + url.PathEscape(name) + "/describe")
+	if err != nil {
+		r.logger.Error("failed to describe sobject", zap.String("name", name), zap.Error(err))
+		return DescribeSObjectResponse{}, err
+	}
+
+	if err := checkResponse(resp); err != nil {
+		return DescribeSObjectResponse{}, err
+	}
+
+	return result, nil
+}
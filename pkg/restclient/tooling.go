@@ -0,0 +1,114 @@
+package restclient
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"go.uber.org/zap"
+)
+
+const (
+	toolingQueryEndpoint         = "/services/data/" + apiVersion + "/tooling/query"
+	toolingChannelMemberEndpoint = "/services/data/" + apiVersion + "/tooling/sobjects/PlatformEventChannelMember"
+
+	// ChangeEventsChannel is the standard channel of the change events published on /data/<Object>ChangeEvent
+	ChangeEventsChannel = "ChangeEvents"
+)
+
+type Tooling interface {
+	GetChannelMembers(ctx context.Context, instanceUrl, accessToken string) ([]ChannelMember, error)
+	CreateChannelMember(ctx context.Context, instanceUrl, accessToken string, req ChannelMemberRequest) (string, error)
+	DeleteChannelMember(ctx context.Context, instanceUrl, accessToken, id string) error
+}
+
+type (
+	// ChannelMember is an entity selected for change data capture in a channel,
+	// e.g. AccountChangeEvent in the standard ChangeEvents channel.
+	ChannelMember struct {
+		ID             string `json:"Id"`
+		EventChannel   string `json:"EventChannel"`
+		SelectedEntity string `json:"SelectedEntity"`
+	}
+
+	ChannelMemberRequest struct {
+		EventChannel   string
+		SelectedEntity string
+		EnrichedFields []string
+	}
+
+	toolingCreateResponse struct {
+		ID      string `json:"id"`
+		Success bool   `json:"success"`
+	}
+)
+
+// GetChannelMembers returns the entities selected for change data capture in all channels of the org.
+func (r *restClient) GetChannelMembers(ctx context.Context, instanceUrl, accessToken string) ([]ChannelMember, error) {
+	q := make(url.Values)
+	q.Add("q", "SELECT Id, EventChannel, SelectedEntity FROM PlatformEventChannelMember")
+	next := toolingQueryEndpoint + "?" + q.Encode()
+
+	members := []ChannelMember{}
+	err := queryPages(ctx, r, instanceUrl, accessToken, next, func(records []ChannelMember) error {
+		members = append(members, records...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// CreateChannelMember enables change data capture for the entity, e.g. AccountChangeEvent,
+// in the channel and returns the ID of the created member.
+func (r *restClient) CreateChannelMember(
+	ctx context.Context,
+	instanceUrl, accessToken string,
+	req ChannelMemberRequest) (string, error) {
+	enrichedFields := make([]map[string]string, 0, len(req.EnrichedFields))
+	for _, field := range req.EnrichedFields {
+		enrichedFields = append(enrichedFields, map[string]string{"name": field})
+	}
+
+	body := map[string]interface{}{
+		"FullName": req.EventChannel + "_" + req.SelectedEntity,
+		"Metadata": map[string]interface{}{
+			"eventChannel":   req.EventChannel,
+			"selectedEntity": req.SelectedEntity,
+			"enrichedFields": enrichedFields,
+		},
+	}
+
+	result := toolingCreateResponse{}
+	resp, err := r.client.R().SetContext(ctx).SetResult(&result).SetBody(body).
+		SetHeader("Authorization", fmt.Sprintf("Bearer %s", accessToken)).
+		Post(instanceUrl + toolingChannelMemberEndpoint)
+	if err != nil {
+		r.logger.Error("failed to create channel member", zap.Error(err))
+		return "", err
+	}
+
+	r.logger.Info("response",
+		zap.Any("body", string(resp.Body())),
+		zap.String("response code", resp.Status()))
+
+	if err := checkResponse(resp); err != nil {
+		return "", err
+	}
+
+	return result.ID, nil
+}
+
+func (r *restClient) DeleteChannelMember(ctx context.Context, instanceUrl, accessToken, id string) error {
+	resp, err := r.client.R().SetContext(ctx).
+		SetHeader("Authorization", fmt.Sprintf("Bearer %s", accessToken)).
+		Delete(instanceUrl + toolingChannelMemberEndpoint + "/" + url.PathEscape(id))
+	if err != nil {
+		r.logger.Error("failed to delete channel member", zap.Error(err))
+		return err
+	}
+
+	return checkResponse(resp)
+}
@@ -0,0 +1,87 @@
+package salesforce
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"github/michaellimmm/salesforce-app-example/pkg/restclient"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// accountToken holds the tokens of an account shared by all of its subscriptions,
+// so that an expired access token is refreshed only once.
+type accountToken struct {
+	mutex   sync.Mutex
+	account models.Account
+}
+
+func newAccountToken(account models.Account) *accountToken {
+	return &accountToken{account: account}
+}
+
+func (t *accountToken) Auth() pubsubclient.Auth {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return pubsubclient.Auth{
+		AccessToken: t.account.AccessToken,
+		InstanceUrl: t.account.InstanceUrl,
+		OrgID:       t.account.OrgID,
+	}
+}
+
+// refreshToken gets a new access token with the refresh token of the account and persists it.
+// Nothing is done when the expired token has already been replaced by another subscription.
+func (s *salesforce) refreshToken(ctx context.Context, token *accountToken, expiredToken string) error {
+	token.mutex.Lock()
+	defer token.mutex.Unlock()
+
+	if expiredToken != "" && token.account.AccessToken != expiredToken {
+		return nil
+	}
+
+	res, err := s.restClient.GetToken(ctx, restclient.TokenRequest{
+		GrantType:    restclient.GrantTypeRefreshToken,
+		RefreshToken: token.account.RefreshToken,
+		ClientID:     token.account.ClientID,
+		ClientSecret: token.account.ClientSecret,
+	})
+	if err != nil {
+		s.logger.Error("failed to refresh token",
+			zap.String("org_id", token.account.OrgID),
+			zap.Error(err))
+		return err
+	}
+
+	token.account.AccessToken = res.AccessToken
+	if res.RefreshToken != "" {
+		token.account.RefreshToken = res.RefreshToken
+	}
+	if res.InstanceUrl != "" {
+		token.account.InstanceUrl = res.InstanceUrl
+	}
+
+	// the cached account may hold outdated subscribed objects, only the token is written
+	return token.account.UpdateToken(ctx)
+}
+
+// withAccessToken calls fn with the auth of the account, refreshing the access token
+// and calling fn again when the REST API rejects it.
+func (s *salesforce) withAccessToken(
+	ctx context.Context,
+	token *accountToken,
+	fn func(auth pubsubclient.Auth) error) error {
+	auth := token.Auth()
+	err := fn(auth)
+	if !restclient.IsUnauthorized(err) {
+		return err
+	}
+
+	if err := s.refreshToken(ctx, token, auth.AccessToken); err != nil {
+		return err
+	}
+
+	return fn(token.Auth())
+}
@@ -0,0 +1,165 @@
+package salesforce
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// scheduleBackfills schedules the backfill of the standard and custom objects that are newly selected,
+// so that their existing records are snapshotted before their subscription starts.
+func (s *salesforce) scheduleBackfills(ctx context.Context, account models.Account, previous models.SubscribedObjects) error {
+	for _, object := range account.SubscribedObjects {
+		topic, err := ParseTopic(object.Name)
+		if err != nil || (topic.Kind != TopicKindStandardObject && topic.Kind != TopicKindCustomObject) {
+			continue
+		}
+
+		if _, ok := previous.Find(object.Name); ok {
+			continue
+		}
+
+		backfill := models.Backfill{
+			OrgID:      account.OrgID,
+			TopicName:  topic.TopicName,
+			EntityName: topic.Name,
+		}
+		if err := backfill.Upsert(ctx); err != nil {
+			s.logger.Error("failed to schedule backfill", zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backfill runs the pending backfill of the topic, if any. The latest replay ID of the topic is captured
+// before the records are queried and is checkpointed once all of them have been emitted as SNAPSHOT
+// events, so that the subscription continues with the changes made while the snapshot was taken.
+// A backfill that fails keeps its captured replay ID and is started again with the subscription.
+// It reports whether the subscription must start from the earliest retained event instead, because
+// no position could be captured and the subscription has no checkpoint yet.
+func (s *salesforce) backfill(ctx context.Context, token *accountToken, topic string) (bool, error) {
+	auth := token.Auth()
+	backfill := models.Backfill{OrgID: auth.OrgID, TopicName: topic}
+	if err := backfill.FindByOrgIDAndTopic(ctx); err != nil {
+		if errors.Is(err, models.ErrDataNotFound) {
+			return false, nil
+		}
+
+		s.logger.Error("failed to get backfill", zap.Error(err))
+		return false, err
+	}
+
+	logger := s.logger.With(
+		zap.String("org_id", backfill.OrgID),
+		zap.String("topic", topic),
+		zap.String("entity", backfill.EntityName))
+
+	if backfill.Status == models.BackfillStatusCompleted {
+		return s.startEarliest(ctx, &backfill)
+	}
+
+	err := s.runBackfill(ctx, token, &backfill)
+	backfill.Attempts++
+	backfill.Error = errorString(err)
+	if err == nil {
+		now := time.Now()
+		backfill.Status = models.BackfillStatusCompleted
+		backfill.CompletedAt = &now
+		logger.Info("backfill completed",
+			zap.Int64("records", backfill.Records),
+			zap.Bool("start_earliest", backfill.StartEarliest))
+	} else {
+		logger.Error("backfill failed", zap.Int("attempts", backfill.Attempts), zap.Error(err))
+	}
+
+	if err := backfill.Update(context.WithoutCancel(ctx)); err != nil {
+		logger.Error("failed to update backfill", zap.Error(err))
+		return false, err
+	}
+
+	return backfill.StartEarliest, err
+}
+
+func (s *salesforce) runBackfill(ctx context.Context, token *accountToken, backfill *models.Backfill) error {
+	if backfill.ReplayID == nil && !backfill.StartEarliest {
+		err := s.withAuth(ctx, token, func(auth pubsubclient.Auth) error {
+			var err error
+			backfill.ReplayID, err = s.pubsubclient.LatestReplayID(ctx, auth, backfill.TopicName)
+			return err
+		})
+		if errors.Is(err, pubsubclient.ErrReplayIDUnavailable) {
+			// the events published while the snapshot is taken are only known to be delivered
+			// when the subscription starts from the earliest retained event
+			backfill.StartEarliest = true
+		} else if err != nil {
+			return err
+		}
+
+		// the position is kept when the snapshot fails, the records changed since are emitted again
+		if err := backfill.Update(ctx); err != nil {
+			return err
+		}
+	}
+
+	snapshot := newSnapshotEmitter(pubsubclient.Event{
+		OrgID:     backfill.OrgID,
+		TopicName: backfill.TopicName,
+		ReplayID:  backfill.ReplayID,
+	}, backfill.EntityName, ChangeOriginBackfill, s.handlers)
+	err := s.snapshotRecords(ctx, token, snapshot, "")
+	backfill.Records = snapshot.sequenceNumber
+	if err != nil {
+		return err
+	}
+
+	if backfill.StartEarliest {
+		return nil
+	}
+
+	return s.subscriptionCheckpoints().SaveReplayID(ctx, backfill.OrgID, backfill.TopicName, backfill.ReplayID)
+}
+
+// startEarliest reports whether the subscription of the completed backfill starts from the earliest retained
+// event, which is only the case until the subscription has a checkpoint.
+func (s *salesforce) startEarliest(ctx context.Context, backfill *models.Backfill) (bool, error) {
+	if !backfill.StartEarliest {
+		return false, nil
+	}
+
+	replayID, err := s.checkpoints.LoadReplayID(ctx, backfill.OrgID, backfill.TopicName)
+	if err != nil {
+		return false, err
+	}
+	if replayID == nil {
+		return true, nil
+	}
+
+	backfill.StartEarliest = false
+	if err := backfill.Update(ctx); err != nil {
+		s.logger.Error("failed to update backfill", zap.Error(err))
+		return false, err
+	}
+
+	return false, nil
+}
+
+// withAuth calls fn with the auth of the token, refreshing the access token once if it has expired.
+func (s *salesforce) withAuth(ctx context.Context, token *accountToken, fn func(auth pubsubclient.Auth) error) error {
+	auth := token.Auth()
+	err := fn(auth)
+	if !pubsubclient.IsAuthError(err) {
+		return err
+	}
+
+	if err := s.refreshToken(ctx, token, auth.AccessToken); err != nil {
+		return err
+	}
+
+	return fn(token.Auth())
+}
@@ -0,0 +1,201 @@
+package salesforce
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	broadcastHandlerName = "broadcast"
+	// number of events buffered for a stream before it is dropped
+	broadcastBuffer = 64
+	// how often the events broadcast by the other instances are polled
+	broadcastPollInterval = time.Second
+	// how far back the events broadcast by the other instances are polled, their IDs are generated
+	// with the clocks of the instances and are not stored in order
+	broadcastLookback = 5 * time.Second
+)
+
+type (
+	// broadcaster is an event handler that publishes the events to the live streams of the same org
+	// and topic. It never blocks: a stream that doesn't keep up is dropped and its channel is closed.
+	// With leases, the events are only received by the instance holding the lease of their subscription,
+	// so they are also stored for a short while and the other instances poll them, see relay.
+	broadcaster struct {
+		logger     *zap.Logger
+		instanceID string
+		mutex      sync.Mutex
+		streams    map[*eventStream]struct{}
+	}
+
+	eventStream struct {
+		orgID  string
+		topic  string
+		events chan pubsubclient.Event
+	}
+)
+
+func newBroadcaster(logger *zap.Logger) *broadcaster {
+	return &broadcaster{
+		logger:  logger,
+		streams: make(map[*eventStream]struct{}),
+	}
+}
+
+func (b *broadcaster) subscribe(orgID, topic string) *eventStream {
+	stream := &eventStream{
+		orgID:  orgID,
+		topic:  topic,
+		events: make(chan pubsubclient.Event, broadcastBuffer),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.streams[stream] = struct{}{}
+	return stream
+}
+
+// unsubscribe removes the stream and closes its channel, unless it has already been dropped.
+func (b *broadcaster) unsubscribe(stream *eventStream) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.streams[stream]; ok {
+		delete(b.streams, stream)
+		close(stream.events)
+	}
+}
+
+// HandleEvent publishes the event to the streams of the instance and, when it is shared with the other
+// instances, stores it for them. A failure to store it doesn't fail the event, the broadcast is best effort.
+func (b *broadcaster) HandleEvent(ctx context.Context, event pubsubclient.Event) error {
+	b.publish(event)
+	if b.instanceID == "" {
+		return nil
+	}
+
+	broadcast := models.BroadcastEvent{
+		Instance:      b.instanceID,
+		OrgID:         event.OrgID,
+		TopicName:     event.TopicName,
+		ReplayID:      event.ReplayID,
+		SchemaID:      event.SchemaID,
+		Body:          event.Body,
+		ChangedFields: event.ChangedFields,
+		NulledFields:  event.NulledFields,
+		DiffFields:    event.DiffFields,
+	}
+	if err := broadcast.Save(ctx); err != nil {
+		b.logger.Error("failed to share broadcast event", zap.Error(err))
+	}
+
+	return nil
+}
+
+// relay publishes the events broadcast by the other instances to the streams of the instance until ctx is done.
+func (b *broadcaster) relay(ctx context.Context) {
+	ticker := time.NewTicker(broadcastPollInterval)
+	defer ticker.Stop()
+
+	// the events polled again within the lookback
+	seen := make(map[primitive.ObjectID]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		since := time.Now().Add(-broadcastLookback)
+		filter := models.BroadcastEvent{Instance: b.instanceID}
+		events, err := filter.FindSinceFromOtherInstances(ctx, since)
+		if err != nil {
+			if ctx.Err() == nil {
+				b.logger.Error("failed to poll broadcast events", zap.Error(err))
+			}
+			continue
+		}
+
+		for _, event := range events {
+			if _, ok := seen[event.ID]; ok {
+				continue
+			}
+
+			seen[event.ID] = event.ID.Timestamp()
+			body, _ := bsonValue(event.Body).(map[string]interface{})
+			b.publish(pubsubclient.Event{
+				OrgID:         event.OrgID,
+				TopicName:     event.TopicName,
+				ReplayID:      event.ReplayID,
+				SchemaID:      event.SchemaID,
+				Body:          body,
+				ChangedFields: event.ChangedFields,
+				NulledFields:  event.NulledFields,
+				DiffFields:    event.DiffFields,
+			})
+		}
+
+		for id, createdAt := range seen {
+			if createdAt.Before(since) {
+				delete(seen, id)
+			}
+		}
+	}
+}
+
+// publish sends the event to the streams of its org and topic.
+func (b *broadcaster) publish(event pubsubclient.Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for stream := range b.streams {
+		if stream.orgID != event.OrgID || (stream.topic != "" && stream.topic != event.TopicName) {
+			continue
+		}
+
+		select {
+		case stream.events <- event:
+		default:
+			b.logger.Warn("dropping slow event stream",
+				zap.String("org_id", stream.orgID),
+				zap.String("topic", stream.topic))
+			delete(b.streams, stream)
+			close(stream.events)
+		}
+	}
+}
+
+// StreamEvents returns the events of the account received from now on, of the topic or of all topics
+// when it is empty, until ctx is done. The channel is closed when ctx is done or when the stream is
+// dropped because the events are not received fast enough. With leases, the events received by the other
+// instances are streamed too, about a poll interval later.
+func (s *salesforce) StreamEvents(ctx context.Context, clientID, topic string) (<-chan pubsubclient.Event, error) {
+	account, err := s.findLinkedAccount(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	topicName := ""
+	if topic != "" {
+		parsed, err := ParseTopic(topic)
+		if err != nil {
+			return nil, err
+		}
+		topicName = parsed.TopicName
+	}
+
+	stream := s.broadcaster.subscribe(account.OrgID, topicName)
+	go func() {
+		<-ctx.Done()
+		s.broadcaster.unsubscribe(stream)
+	}()
+
+	return stream.events, nil
+}
@@ -0,0 +1,120 @@
+package salesforce
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"github/michaellimmm/salesforce-app-example/pkg/restclient"
+
+	"go.uber.org/zap"
+)
+
+type ChangeDataCaptureAction string
+
+const (
+	ChangeDataCaptureEnabled  ChangeDataCaptureAction = "ENABLED"
+	ChangeDataCaptureDisabled ChangeDataCaptureAction = "DISABLED"
+)
+
+// ChangeDataCaptureResult is the outcome of enabling or disabling change data capture for an object.
+type ChangeDataCaptureResult struct {
+	Object string
+	Action ChangeDataCaptureAction
+	Error  string
+}
+
+// syncChangeDataCapture enables change data capture for the selected objects that don't have it yet and
+// disables it for the deselected objects it was enabled for by the app. The returned objects carry the IDs of
+// the channel members created by the app.
+func (s *salesforce) syncChangeDataCapture(
+	ctx context.Context,
+	token *accountToken,
+	previous, current models.SubscribedObjects) (models.SubscribedObjects, []ChangeDataCaptureResult, error) {
+	var members []restclient.ChannelMember
+	err := s.withAccessToken(ctx, token, func(auth pubsubclient.Auth) error {
+		var err error
+		members, err = s.restClient.GetChannelMembers(ctx, auth.InstanceUrl, auth.AccessToken)
+		return err
+	})
+	if err != nil {
+		s.logger.Error("failed to get channel members", zap.Error(err))
+		return nil, nil, err
+	}
+
+	enabled := changeEventsEntities(members)
+	results := []ChangeDataCaptureResult{}
+	objects := make(models.SubscribedObjects, 0, len(current))
+	for _, object := range current {
+		if p, ok := previous.Find(object.Name); ok {
+			object.ChannelMemberID = p.ChannelMemberID
+		}
+
+		entity, ok := changeEventEntity(object.Name)
+		if !ok || enabled[entity] {
+			objects = append(objects, object)
+			continue
+		}
+
+		result := ChangeDataCaptureResult{Object: object.Name, Action: ChangeDataCaptureEnabled}
+		err := s.withAccessToken(ctx, token, func(auth pubsubclient.Auth) error {
+			id, err := s.restClient.CreateChannelMember(ctx, auth.InstanceUrl, auth.AccessToken, restclient.ChannelMemberRequest{
+				EventChannel:   restclient.ChangeEventsChannel,
+				SelectedEntity: entity,
+				EnrichedFields: object.EnrichedFields,
+			})
+			object.ChannelMemberID = id
+			return err
+		})
+		if err != nil {
+			s.logger.Error("failed to enable change data capture", zap.String("object", object.Name), zap.Error(err))
+			result.Error = err.Error()
+		}
+
+		results = append(results, result)
+		objects = append(objects, object)
+	}
+
+	for _, object := range previous {
+		if _, ok := current.Find(object.Name); ok || object.ChannelMemberID == "" {
+			continue
+		}
+
+		result := ChangeDataCaptureResult{Object: object.Name, Action: ChangeDataCaptureDisabled}
+		err := s.withAccessToken(ctx, token, func(auth pubsubclient.Auth) error {
+			return s.restClient.DeleteChannelMember(ctx, auth.InstanceUrl, auth.AccessToken, object.ChannelMemberID)
+		})
+		// a member deleted in Salesforce in the meantime is already disabled
+		if err != nil && !restclient.IsNotFound(err) {
+			s.logger.Error("failed to disable change data capture", zap.String("object", object.Name), zap.Error(err))
+			result.Error = err.Error()
+		}
+
+		results = append(results, result)
+	}
+
+	return objects, results, nil
+}
+
+// changeEventsEntities returns the entities selected in the standard ChangeEvents channel, whose events
+// are published on /data/<Object>ChangeEvent. The members of custom channels are only published on their channel.
+func changeEventsEntities(members []restclient.ChannelMember) map[string]bool {
+	enabled := make(map[string]bool, len(members))
+	for _, member := range members {
+		if member.EventChannel == restclient.ChangeEventsChannel {
+			enabled[member.SelectedEntity] = true
+		}
+	}
+
+	return enabled
+}
+
+// changeEventEntity returns the change event entity of an object, e.g. AccountChangeEvent for Account
+// or Foo__ChangeEvent for Foo__c, or false when the name is not an object.
+func changeEventEntity(name string) (string, bool) {
+	topic, err := ParseTopic(name)
+	if err != nil || (topic.Kind != TopicKindStandardObject && topic.Kind != TopicKindCustomObject) {
+		return "", false
+	}
+
+	return topic.TopicName[len(dataTopicPrefix):], true
+}
@@ -0,0 +1,84 @@
+package salesforce
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/db"
+	"github/michaellimmm/salesforce-app-example/gen/pubsubapi"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+)
+
+// ErrLeaseLost is returned when the checkpoint of a subscription is saved by an instance that no longer
+// holds the lease of the subscription.
+var ErrLeaseLost = errors.New("lease of the subscription is lost")
+
+type (
+	// checkpointStore keeps the replay ID of the last processed event per org and topic.
+	checkpointStore struct{}
+
+	// leasedCheckpointStore only saves the checkpoint of a subscription while the instance holds its lease,
+	// so that an instance that lost the lease while it was draining the events already received doesn't
+	// overwrite the checkpoints of the instance that took the lease over, and stops draining instead.
+	leasedCheckpointStore struct {
+		checkpointStore
+		leases *db.LeaseManager
+	}
+)
+
+func (c checkpointStore) SaveReplayID(ctx context.Context, orgID, topicName string, replayID []byte) error {
+	checkpoint := models.Checkpoint{
+		OrgID:     orgID,
+		TopicName: topicName,
+		ReplayID:  replayID,
+	}
+	return checkpoint.Upsert(ctx)
+}
+
+func (c leasedCheckpointStore) SaveReplayID(ctx context.Context, orgID, topicName string, replayID []byte) error {
+	held, err := c.leases.Held(ctx, subscriptionKey(orgID, topicName))
+	if err != nil {
+		return err
+	}
+	if !held {
+		return ErrLeaseLost
+	}
+
+	return c.checkpointStore.SaveReplayID(ctx, orgID, topicName, replayID)
+}
+
+// LoadReplayID returns the stored replay ID of the org and topic, or nil when there is no checkpoint yet.
+func (c checkpointStore) LoadReplayID(ctx context.Context, orgID, topicName string) ([]byte, error) {
+	checkpoint := models.Checkpoint{
+		OrgID:     orgID,
+		TopicName: topicName,
+	}
+	if err := checkpoint.FindByOrgIDAndTopic(ctx); err != nil {
+		if errors.Is(err, models.ErrDataNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return checkpoint.ReplayID, nil
+}
+
+// subscriptionCheckpoints returns the checkpoints of the subscriptions, which are only saved while the
+// instance holds the lease of the subscription when there are leases.
+func (s *salesforce) subscriptionCheckpoints() pubsubclient.Checkpointer {
+	if s.leases == nil {
+		return s.checkpoints
+	}
+
+	return leasedCheckpointStore{leases: s.leases}
+}
+
+// replayPolicy returns the preset used for the topic when no usable checkpoint exists.
+func (s *salesforce) replayPolicy(topicName string) pubsubapi.ReplayPreset {
+	if preset, ok := s.replayPolicies[topicName]; ok {
+		return preset
+	}
+
+	return pubsubapi.ReplayPreset_LATEST
+}
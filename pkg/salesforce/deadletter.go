@@ -0,0 +1,182 @@
+package salesforce
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+type (
+	// DeadLetter is a pending event that could not be decoded or handled.
+	DeadLetter struct {
+		ID        string    `json:"id"`
+		OrgID     string    `json:"org_id"`
+		TopicName string    `json:"topic_name"`
+		ReplayID  []byte    `json:"replay_id"`
+		SchemaID  string    `json:"schema_id"`
+		Error     string    `json:"error"`
+		Attempts  int       `json:"attempts"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+
+	// deadLetterStore is a dead letter queue stored in the dead letter collection.
+	deadLetterStore struct {
+		logger *zap.Logger
+	}
+)
+
+func (d *deadLetterStore) DeadLetter(ctx context.Context, letter pubsubclient.DeadLetter) error {
+	record := models.DeadLetter{
+		OrgID:     letter.OrgID,
+		TopicName: letter.TopicName,
+		ReplayID:  letter.ReplayID,
+		SchemaID:  letter.SchemaID,
+		Payload:   letter.Payload,
+		Error:     letter.Error,
+		Attempts:  letter.Attempts,
+	}
+
+	if err := record.Upsert(ctx); err != nil {
+		d.logger.Error("failed to save dead letter", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// ListDeadLetters returns the pending dead letters of the account, or of all accounts when clientID is empty.
+func (s *salesforce) ListDeadLetters(ctx context.Context, clientID string) ([]DeadLetter, error) {
+	record := models.DeadLetter{}
+	if clientID != "" {
+		account, err := s.findAccount(ctx, clientID)
+		if err != nil {
+			return nil, err
+		}
+		record.OrgID = account.OrgID
+	}
+
+	records, err := record.FindAllByOrgID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := make([]DeadLetter, 0, len(records))
+	for _, r := range records {
+		letters = append(letters, DeadLetter{
+			ID:        r.ID.Hex(),
+			OrgID:     r.OrgID,
+			TopicName: r.TopicName,
+			ReplayID:  r.ReplayID,
+			SchemaID:  r.SchemaID,
+			Error:     r.Error,
+			Attempts:  r.Attempts,
+			CreatedAt: r.CreatedAt,
+			UpdatedAt: r.UpdatedAt,
+		})
+	}
+
+	return letters, nil
+}
+
+// RetryDeadLetter decodes the dead-lettered event again and passes it to the registered handlers.
+// The dead letter is removed when it succeeds, otherwise its error and attempts are updated.
+// An empty clientID allows the dead letters of all accounts.
+func (s *salesforce) RetryDeadLetter(ctx context.Context, clientID, id string) error {
+	record, err := s.findDeadLetter(ctx, clientID, id)
+	if err != nil {
+		return err
+	}
+
+	account := models.Account{OrgID: record.OrgID}
+	if err := account.FindByOrgID(ctx); err != nil {
+		s.logger.Error("failed to get account by orgID", zap.Error(err))
+		return err
+	}
+
+	token := s.accountToken(account)
+	err = s.retryDeadLetter(ctx, token, record)
+	if err == nil {
+		return record.Delete(ctx, models.DeadLetterStatusRetried)
+	}
+
+	s.logger.Warn("failed to retry dead letter", zap.String("id", id), zap.Error(err))
+	record.Error = err.Error()
+	record.Attempts++
+	if err := record.Update(ctx); err != nil {
+		return err
+	}
+
+	return err
+}
+
+func (s *salesforce) retryDeadLetter(ctx context.Context, token *accountToken, record models.DeadLetter) error {
+	event, err := s.pubsubclient.Decode(ctx, token.Auth(), pubsubclient.RawEvent{
+		OrgID:     record.OrgID,
+		TopicName: record.TopicName,
+		ReplayID:  record.ReplayID,
+		SchemaID:  record.SchemaID,
+		Payload:   record.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.eventHandler(token).HandleEvent(ctx, event)
+}
+
+// DiscardDeadLetter removes the dead letter without handling it.
+// An empty clientID allows the dead letters of all accounts.
+func (s *salesforce) DiscardDeadLetter(ctx context.Context, clientID, id string) error {
+	record, err := s.findDeadLetter(ctx, clientID, id)
+	if err != nil {
+		return err
+	}
+
+	return record.Delete(ctx, models.DeadLetterStatusDiscarded)
+}
+
+func (s *salesforce) findDeadLetter(ctx context.Context, clientID, id string) (models.DeadLetter, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.DeadLetter{}, ErrDeadLetterNotFound
+	}
+
+	record := models.DeadLetter{ID: objectID}
+	if err := record.FindByID(ctx); err != nil {
+		if errors.Is(err, models.ErrDataNotFound) {
+			return models.DeadLetter{}, ErrDeadLetterNotFound
+		}
+		return models.DeadLetter{}, err
+	}
+
+	if clientID != "" {
+		account, err := s.findAccount(ctx, clientID)
+		if err != nil {
+			return models.DeadLetter{}, err
+		}
+
+		if account.OrgID != record.OrgID {
+			return models.DeadLetter{}, ErrDeadLetterNotFound
+		}
+	}
+
+	return record, nil
+}
+
+func (s *salesforce) findAccount(ctx context.Context, clientID string) (models.Account, error) {
+	account := models.Account{ClientID: clientID}
+	if err := account.FindByClientID(ctx); err != nil {
+		s.logger.Error("failed to get account by clientID", zap.Error(err))
+		return models.Account{}, err
+	}
+
+	return account, nil
+}
@@ -0,0 +1,89 @@
+package salesforce
+
+import (
+	"context"
+	"encoding/hex"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// events can't be replayed after the 72 hours they are retained by Salesforce
+	defaultDedupWindow = 72 * time.Hour
+	// how long an event is claimed while it is handled
+	dedupClaimTimeout = 5 * time.Minute
+)
+
+// dedupHandler drops the events that have already been handled, e.g. when they are received again
+// after a reconnect or a replay, and remembers the events it handled for the dedup window. An event is
+// claimed before it is handled, so that it is handled once when it is received by two subscriptions at
+// the same time, and the claim is removed when handling fails. The claim of an instance that stopped
+// while handling the event expires after dedupClaimTimeout.
+type dedupHandler struct {
+	logger *zap.Logger
+	window time.Duration
+	next   pubsubclient.EventHandler
+}
+
+func (h *dedupHandler) HandleEvent(ctx context.Context, event pubsubclient.Event) error {
+	delivered := models.DeliveredEvent{
+		Key:       dedupKey(event),
+		OrgID:     event.OrgID,
+		TopicName: event.TopicName,
+		ExpiresAt: time.Now().Add(dedupClaimTimeout),
+	}
+
+	claimed, err := delivered.Claim(ctx)
+	if err != nil {
+		h.logger.Error("failed to claim event", zap.Error(err))
+		return err
+	}
+
+	if !claimed {
+		h.logger.Info("dropping duplicate event",
+			zap.String("org_id", event.OrgID),
+			zap.String("topic", event.TopicName),
+			zap.String("key", delivered.Key))
+		return nil
+	}
+
+	if err := h.next.HandleEvent(ctx, event); err != nil {
+		if err := delivered.Release(context.WithoutCancel(ctx)); err != nil {
+			h.logger.Error("failed to release event", zap.Error(err))
+		}
+		return err
+	}
+
+	delivered.ExpiresAt = time.Now().Add(h.window)
+	if err := delivered.Confirm(ctx); err != nil {
+		h.logger.Error("failed to save delivered event", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// dedupKey identifies an event of a topic: a change event by its transaction key and sequence number,
+// which are the same when the change is published again, and any other event by its replay ID.
+func dedupKey(event pubsubclient.Event) string {
+	key := event.OrgID + event.TopicName + "/"
+	if header, ok := event.ChangeEventHeader(); ok && header.TransactionKey != "" {
+		return key + header.TransactionKey + "/" + strconv.FormatInt(header.SequenceNumber, 10)
+	}
+
+	return key + hex.EncodeToString(event.ReplayID)
+}
+
+// eventHandler returns the handler of the events received for the account: duplicates are dropped,
+// and the other events are reconciled and dispatched to the registered handlers.
+func (s *salesforce) eventHandler(token *accountToken) pubsubclient.EventHandler {
+	return &dedupHandler{
+		logger: s.logger,
+		window: s.dedupWindow,
+		next:   &reconcilingHandler{s: s, token: token},
+	}
+}
@@ -0,0 +1,56 @@
+package salesforce
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const EventStoreHandlerName = "event_store"
+
+// eventStore is an event handler that persists every event received from Salesforce to the event collection.
+// The events emitted by a reconciliation or a backfill share the replay ID of another event and are not stored.
+type eventStore struct {
+	logger *zap.Logger
+}
+
+func NewEventStore(logger *zap.Logger) pubsubclient.EventHandler {
+	return &eventStore{logger: logger}
+}
+
+func (e *eventStore) HandleEvent(ctx context.Context, event pubsubclient.Event) error {
+	record := models.Event{
+		OrgID:           event.OrgID,
+		TopicName:       event.TopicName,
+		ReplayID:        event.ReplayID,
+		SchemaID:        event.SchemaID,
+		CommitTimestamp: time.Now(),
+		ChangedFields:   event.ChangedFields,
+		NulledFields:    event.NulledFields,
+		DiffFields:      event.DiffFields,
+		Payload:         event.Body,
+	}
+
+	if header, ok := event.ChangeEventHeader(); ok {
+		if header.ChangeOrigin == ChangeOriginReconciliation || header.ChangeOrigin == ChangeOriginBackfill {
+			return nil
+		}
+
+		record.EntityName = header.EntityName
+		record.ChangeType = header.ChangeType
+		record.RecordIDs = header.RecordIDs
+		if !header.CommitTimestamp.IsZero() {
+			record.CommitTimestamp = header.CommitTimestamp
+		}
+	}
+
+	if err := record.Save(ctx); err != nil {
+		e.logger.Error("failed to save event", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+package salesforce
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"sync"
+	"time"
+)
+
+// how long the handlers that succeeded for an event that failed are skipped when it is handled again,
+// longer than the retries of a subscription
+const partialDeliveryTTL = 10 * time.Minute
+
+type (
+	// handlerRegistry dispatches the events of every subscription to the handlers
+	// registered for the org and topic of the event. When some of the handlers fail, the handlers
+	// that succeeded are remembered for partialDeliveryTTL, so that they are skipped when the event
+	// is handled again, e.g. when it is retried.
+	handlerRegistry struct {
+		mutex    sync.RWMutex
+		handlers []registeredHandler
+
+		partialMutex sync.Mutex
+		partial      map[string]partialDelivery
+	}
+
+	// partialDelivery holds the names of the handlers that succeeded for an event that failed.
+	partialDelivery struct {
+		handled   map[string]bool
+		updatedAt time.Time
+	}
+
+	registeredHandler struct {
+		name    string
+		orgID   string
+		topic   string
+		handler pubsubclient.EventHandler
+	}
+)
+
+func (r *handlerRegistry) register(h registeredHandler) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i := 0; i < len(r.handlers); i++ {
+		if r.handlers[i].name == h.name {
+			r.handlers[i] = h
+			return
+		}
+	}
+
+	r.handlers = append(r.handlers, h)
+}
+
+func (r *handlerRegistry) unregister(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i := 0; i < len(r.handlers); i++ {
+		if r.handlers[i].name == name {
+			r.handlers = append(r.handlers[:i], r.handlers[i+1:]...)
+			return
+		}
+	}
+}
+
+func (r *handlerRegistry) match(orgID, topic string) []registeredHandler {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	var handlers []registeredHandler
+	for _, h := range r.handlers {
+		if h.matches(orgID, topic) {
+			handlers = append(handlers, h)
+		}
+	}
+
+	return handlers
+}
+
+// lookup returns the handler registered under the name.
+func (r *handlerRegistry) lookup(name string) (registeredHandler, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, h := range r.handlers {
+		if h.name == name {
+			return h, true
+		}
+	}
+
+	return registeredHandler{}, false
+}
+
+func (h registeredHandler) matches(orgID, topic string) bool {
+	return (h.orgID == "" || h.orgID == orgID) && (h.topic == "" || h.topic == topic)
+}
+
+// HandleEvent calls the matching handlers that have not handled the event yet and returns their joined errors.
+func (r *handlerRegistry) HandleEvent(ctx context.Context, event pubsubclient.Event) error {
+	key := dedupKey(event)
+	handled := r.handled(key)
+
+	var errs []error
+	for _, h := range r.match(event.OrgID, event.TopicName) {
+		if handled[h.name] {
+			continue
+		}
+
+		if err := h.handler.HandleEvent(ctx, event); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		handled[h.name] = true
+	}
+
+	r.remember(key, handled, len(errs) > 0)
+	return errors.Join(errs...)
+}
+
+// handled returns the names of the handlers that succeeded when the event was last handled.
+func (r *handlerRegistry) handled(key string) map[string]bool {
+	r.partialMutex.Lock()
+	defer r.partialMutex.Unlock()
+
+	handled := make(map[string]bool)
+	if delivery, ok := r.partial[key]; ok && time.Since(delivery.updatedAt) < partialDeliveryTTL {
+		for name := range delivery.handled {
+			handled[name] = true
+		}
+	}
+
+	return handled
+}
+
+// remember keeps the handlers that succeeded for an event that failed, and forgets them once it succeeded.
+func (r *handlerRegistry) remember(key string, handled map[string]bool, failed bool) {
+	r.partialMutex.Lock()
+	defer r.partialMutex.Unlock()
+
+	if !failed {
+		delete(r.partial, key)
+		return
+	}
+
+	now := time.Now()
+	for k, delivery := range r.partial {
+		if now.Sub(delivery.updatedAt) >= partialDeliveryTTL {
+			delete(r.partial, k)
+		}
+	}
+
+	if r.partial == nil {
+		r.partial = make(map[string]partialDelivery)
+	}
+	r.partial[key] = partialDelivery{handled: handled, updatedAt: now}
+}
+
+// RegisterHandler registers a handler for the events of the given org and topic under a unique name,
+// replacing any handler previously registered with the same name. An empty org ID or topic matches all.
+func (s *salesforce) RegisterHandler(name, orgID, topic string, handler pubsubclient.EventHandler) {
+	s.handlers.register(registeredHandler{
+		name:    name,
+		orgID:   orgID,
+		topic:   topic,
+		handler: handler,
+	})
+}
+
+func (s *salesforce) UnregisterHandler(name string) {
+	s.handlers.unregister(name)
+}
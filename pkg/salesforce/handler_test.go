@@ -0,0 +1,58 @@
+package salesforce
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"testing"
+)
+
+// countingHandler counts its calls and fails the first failures calls.
+type countingHandler struct {
+	calls    int
+	failures int
+}
+
+func (h *countingHandler) HandleEvent(ctx context.Context, event pubsubclient.Event) error {
+	h.calls++
+	if h.calls <= h.failures {
+		return errors.New("handler failed")
+	}
+
+	return nil
+}
+
+func TestHandlerRegistryRetriesFailedHandlers(t *testing.T) {
+	ok := &countingHandler{}
+	failing := &countingHandler{failures: 2}
+
+	r := &handlerRegistry{}
+	r.register(registeredHandler{name: "ok", handler: ok})
+	r.register(registeredHandler{name: "failing", handler: failing})
+
+	event := pubsubclient.Event{OrgID: "org", TopicName: "/event/Foo__e", ReplayID: []byte{1}}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := r.HandleEvent(ctx, event); err == nil {
+			t.Fatalf("attempt %d succeeded, want the error of the failing handler", i+1)
+		}
+	}
+	if err := r.HandleEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok.calls != 1 {
+		t.Fatalf("handler that succeeded called %d times, want 1", ok.calls)
+	}
+	if failing.calls != 3 {
+		t.Fatalf("failing handler called %d times, want 3", failing.calls)
+	}
+
+	// the event is handled by all handlers again once it succeeded, e.g. when it is replayed
+	if err := r.HandleEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if ok.calls != 2 || failing.calls != 4 {
+		t.Fatalf("handlers called %d and %d times, want 2 and 4", ok.calls, failing.calls)
+	}
+}
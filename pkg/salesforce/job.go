@@ -0,0 +1,104 @@
+package salesforce
+
+import (
+	"context"
+	"sync"
+)
+
+type (
+	// jobRunner runs jobs of the instance in the background, each with its own context,
+	// e.g. the replay jobs or the reconciliations of the objects of a topic.
+	jobRunner struct {
+		mutex sync.Mutex
+		jobs  map[string]*runningJob
+		wg    sync.WaitGroup
+	}
+
+	runningJob struct {
+		cancel context.CancelFunc
+		// next runs once the job has finished, see jobRunner.rerun
+		next func(ctx context.Context)
+	}
+)
+
+func newJobRunner() *jobRunner {
+	return &jobRunner{jobs: make(map[string]*runningJob)}
+}
+
+// start runs the job in the background unless it is already running.
+func (r *jobRunner) start(ctx context.Context, id string, run func(ctx context.Context)) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.jobs[id]; ok {
+		return false
+	}
+
+	r.run(ctx, id, run)
+	return true
+}
+
+// rerun runs the job in the background, or once more after the running job finishes when it is already running,
+// so that the job started last always runs to completion. It reports whether the job was started now.
+func (r *jobRunner) rerun(ctx context.Context, id string, run func(ctx context.Context)) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if job, ok := r.jobs[id]; ok {
+		job.next = run
+		return false
+	}
+
+	r.run(ctx, id, run)
+	return true
+}
+
+// run runs the job and the reruns queued while it is running, r.mutex must be held.
+func (r *jobRunner) run(ctx context.Context, id string, run func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(ctx)
+	job := &runningJob{cancel: cancel}
+	r.jobs[id] = job
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer cancel()
+
+		for {
+			run(ctx)
+
+			r.mutex.Lock()
+			run, job.next = job.next, nil
+			if run == nil || ctx.Err() != nil {
+				delete(r.jobs, id)
+				r.mutex.Unlock()
+				return
+			}
+			r.mutex.Unlock()
+		}
+	}()
+}
+
+func (r *jobRunner) cancel(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if job, ok := r.jobs[id]; ok {
+		job.cancel()
+	}
+}
+
+// wait waits until the jobs have stopped or ctx is done.
+func (r *jobRunner) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,176 @@
+package salesforce
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/db"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// leaseKeeper makes sure that the subscription of every (org, topic) runs on a single instance.
+// The subscriptions are spread over the live instances by rendezvous hashing: an instance only
+// acquires the leases of the subscriptions it is the preferred owner of and hands a lease over
+// when another instance becomes the preferred owner, e.g. when a new instance joins. The lease
+// of an instance that dies expires and is acquired by the next preferred owner. The checkpoints of a
+// subscription are only saved while its lease is held, see leasedCheckpointStore.
+type leaseKeeper struct {
+	logger   *zap.Logger
+	leases   *db.LeaseManager
+	interval time.Duration
+
+	mutex     sync.RWMutex
+	instances []string
+}
+
+func newLeaseKeeper(logger *zap.Logger, leases *db.LeaseManager) *leaseKeeper {
+	return &leaseKeeper{
+		logger:    logger,
+		leases:    leases,
+		interval:  leases.TTL() / 3,
+		instances: []string{leases.InstanceID()},
+	}
+}
+
+// run sends the heartbeats of the instance and refreshes the live instances until ctx is done.
+func (k *leaseKeeper) run(ctx context.Context) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	for {
+		k.heartbeat(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (k *leaseKeeper) heartbeat(ctx context.Context) {
+	if err := k.leases.Heartbeat(ctx); err != nil {
+		k.logger.Error("failed to send heartbeat", zap.Error(err))
+		return
+	}
+
+	instances, err := k.leases.Instances(ctx)
+	if err != nil {
+		k.logger.Error("failed to get instances", zap.Error(err))
+		return
+	}
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	if len(instances) != len(k.instances) {
+		k.logger.Info("instances changed", zap.Strings("instances", instances))
+	}
+	k.instances = instances
+}
+
+// preferred reports whether the instance is the preferred owner of the key among the live instances.
+func (k *leaseKeeper) preferred(key string) bool {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	self := k.leases.InstanceID()
+	owner := self
+	var best uint64
+	for _, instance := range k.instances {
+		h := fnv.New64a()
+		h.Write([]byte(instance + "/" + key))
+		if sum := h.Sum64(); sum > best || (sum == best && instance < owner) {
+			best = sum
+			owner = instance
+		}
+	}
+
+	return owner == self
+}
+
+// hold waits until the instance holds the lease of the key, calling standby while another instance
+// owns it. The returned context is canceled when the lease is lost or handed over, and release
+// must be called once the subscription has stopped.
+func (k *leaseKeeper) hold(
+	ctx context.Context,
+	key string,
+	standby func()) (leaseCtx context.Context, release func(), err error) {
+	for {
+		if k.preferred(key) {
+			ok, err := k.leases.Acquire(ctx, key)
+			if err != nil {
+				k.logger.Error("failed to acquire lease", zap.String("key", key), zap.Error(err))
+			}
+			if ok {
+				break
+			}
+		}
+
+		standby()
+
+		timer := time.NewTimer(k.interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	leaseCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		k.renew(leaseCtx, cancel, key)
+	}()
+
+	release = func() {
+		cancel()
+		<-done
+
+		ctx, cancel := context.WithTimeout(context.Background(), k.interval)
+		defer cancel()
+		if err := k.leases.Release(ctx, key); err != nil {
+			k.logger.Error("failed to release lease", zap.String("key", key), zap.Error(err))
+		}
+	}
+
+	return leaseCtx, release, nil
+}
+
+// renew renews the lease until ctx is done and cancels it when the lease is lost,
+// can't be renewed before it expires or should be handed over to another instance.
+func (k *leaseKeeper) renew(ctx context.Context, cancel context.CancelFunc, key string) {
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !k.preferred(key) {
+			k.logger.Info("handing lease over to another instance", zap.String("key", key))
+			cancel()
+			return
+		}
+
+		ok, err := k.leases.Renew(ctx, key)
+		switch {
+		case err != nil && time.Since(renewed) < k.leases.TTL()-k.interval:
+			k.logger.Warn("failed to renew lease", zap.String("key", key), zap.Error(err))
+		case err != nil, !ok:
+			k.logger.Warn("lease lost", zap.String("key", key), zap.Error(err))
+			cancel()
+			return
+		default:
+			renewed = time.Now()
+		}
+	}
+}
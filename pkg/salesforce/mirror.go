@@ -0,0 +1,136 @@
+package salesforce
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const MirrorHandlerName = "mirror"
+
+// recordMirror is an event handler that keeps a copy of the records of the change events in a collection
+// per org and object, see models.MirroredRecord. An update only sets its changed fields and removes its
+// nulled fields, a delete soft deletes the record and a snapshot of a reconciliation replaces it.
+// Gap events are skipped, their records are mirrored from the snapshots of the reconciliation.
+type recordMirror struct {
+	logger *zap.Logger
+}
+
+func NewRecordMirror(logger *zap.Logger) pubsubclient.EventHandler {
+	return &recordMirror{logger: logger}
+}
+
+func (m *recordMirror) HandleEvent(ctx context.Context, event pubsubclient.Event) error {
+	header, ok := event.ChangeEventHeader()
+	if !ok || header.IsGap() {
+		return nil
+	}
+
+	commitTimestamp := header.CommitTimestamp
+	if commitTimestamp.IsZero() {
+		commitTimestamp = time.Now()
+	}
+
+	fields := event.Fields()
+	for _, recordID := range header.RecordIDs {
+		record := models.MirroredRecord{
+			OrgID:           event.OrgID,
+			EntityName:      header.EntityName,
+			RecordID:        recordID,
+			CommitTimestamp: commitTimestamp,
+		}
+
+		var err error
+		switch header.ChangeType {
+		case pubsubclient.ChangeTypeCreate:
+			err = record.Merge(ctx, setFields(fields), nil)
+		case pubsubclient.ChangeTypeUpdate:
+			err = record.Merge(ctx, changedFields(fields, event.ChangedFields, event.NulledFields), event.NulledFields)
+		case pubsubclient.ChangeTypeDelete:
+			err = record.Delete(ctx)
+		case pubsubclient.ChangeTypeUndelete:
+			err = record.Undelete(ctx, setFields(fields))
+		case ChangeTypeSnapshot:
+			err = record.Replace(ctx, setFields(fields))
+		default:
+			continue
+		}
+
+		if err != nil {
+			m.logger.Error("failed to mirror record",
+				zap.String("org_id", event.OrgID),
+				zap.String("entity", header.EntityName),
+				zap.String("record_id", recordID),
+				zap.String("change_type", header.ChangeType),
+				zap.Error(err))
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setFields returns the fields that are set, the fields of a change event that are not set are nil.
+func setFields(fields map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = setFields(nested)
+		}
+		if value != nil {
+			result[name] = value
+		}
+	}
+
+	return result
+}
+
+// changedFields returns the values of the changed fields of an update by their path, e.g. Name.FirstName
+// for a field of a compound field. All fields that are set are returned when the changed fields are unknown.
+func changedFields(fields map[string]interface{}, changed, nulled []string) map[string]interface{} {
+	if len(changed) == 0 {
+		return setFields(fields)
+	}
+
+	isNulled := make(map[string]bool, len(nulled))
+	for _, path := range nulled {
+		isNulled[path] = true
+	}
+
+	result := make(map[string]interface{}, len(changed))
+	for _, path := range changed {
+		if isNulled[path] {
+			continue
+		}
+
+		value, ok := fieldValue(fields, path)
+		if !ok {
+			continue
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			value = setFields(nested)
+		}
+		result[path] = value
+	}
+
+	return result
+}
+
+func fieldValue(fields map[string]interface{}, path string) (interface{}, bool) {
+	name, rest, nested := strings.Cut(path, ".")
+	value, ok := fields[name]
+	if !ok || !nested {
+		return value, ok && value != nil
+	}
+
+	compound, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	return fieldValue(compound, rest)
+}
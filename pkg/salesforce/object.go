@@ -0,0 +1,160 @@
+package salesforce
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"github/michaellimmm/salesforce-app-example/pkg/restclient"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// how long the objects discovered in an org are cached
+const objectCacheTTL = 10 * time.Minute
+
+type (
+	// SubscribableObject is an object of the org that supports change data capture.
+	SubscribableObject struct {
+		Name   string
+		Label  string
+		Topic  string
+		Custom bool
+		// Enabled reports whether change data capture is currently enabled for the object in the org
+		Enabled bool
+	}
+
+	objectCache struct {
+		mutex   sync.Mutex
+		entries map[string]objectCacheEntry
+	}
+
+	objectCacheEntry struct {
+		objects   []SubscribableObject
+		fetchedAt time.Time
+	}
+)
+
+// StandardObjectList is shown when the objects of the org can't be discovered.
+var StandardObjectList = []SubscribableObject{
+	{Name: "Account", Label: "Account", Topic: "/data/AccountChangeEvent"},
+	{Name: "Event", Label: "Event", Topic: "/data/EventChangeEvent"},
+	{Name: "Opportunity", Label: "Opportunity", Topic: "/data/OpportunityChangeEvent"},
+	{Name: "Case", Label: "Case", Topic: "/data/CaseChangeEvent"},
+	{Name: "Order", Label: "Order", Topic: "/data/OrderChangeEvent"},
+}
+
+func (c *objectCache) get(orgID string) ([]SubscribableObject, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[orgID]
+	if !ok || time.Since(entry.fetchedAt) > objectCacheTTL {
+		return nil, false
+	}
+
+	return entry.objects, true
+}
+
+func (c *objectCache) set(orgID string, objects []SubscribableObject) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries[orgID] = objectCacheEntry{
+		objects:   objects,
+		fetchedAt: time.Now(),
+	}
+}
+
+func (c *objectCache) forget(orgID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.entries, orgID)
+}
+
+// ListSubscribableObjects returns the objects of the org of the account that support change data capture.
+func (s *salesforce) ListSubscribableObjects(ctx context.Context, clientID string) ([]SubscribableObject, error) {
+	account, err := s.findLinkedAccount(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	if objects, ok := s.objects.get(account.OrgID); ok {
+		return objects, nil
+	}
+
+	var (
+		describe restclient.DescribeGlobalResponse
+		members  []restclient.ChannelMember
+	)
+	err = s.withAccessToken(ctx, s.accountToken(account), func(auth pubsubclient.Auth) error {
+		var err error
+		describe, err = s.restClient.DescribeGlobal(ctx, auth.InstanceUrl, auth.AccessToken)
+		if err != nil {
+			return err
+		}
+
+		members, err = s.restClient.GetChannelMembers(ctx, auth.InstanceUrl, auth.AccessToken)
+		return err
+	})
+	if err != nil {
+		s.logger.Error("failed to discover objects", zap.Error(err))
+		return nil, err
+	}
+
+	objects := subscribableObjects(describe, members)
+	s.objects.set(account.OrgID, objects)
+
+	return objects, nil
+}
+
+// subscribableObjects returns the objects that have a change event object, e.g. Account for
+// AccountChangeEvent or Foo__c for Foo__ChangeEvent, sorted by label. An object is enabled when it is
+// selected in the ChangeEvents channel.
+func subscribableObjects(describe restclient.DescribeGlobalResponse, members []restclient.ChannelMember) []SubscribableObject {
+	enabled := changeEventsEntities(members)
+
+	byName := make(map[string]restclient.SObjectDescribe, len(describe.SObjects))
+	for _, sobject := range describe.SObjects {
+		byName[sobject.Name] = sobject
+	}
+
+	objects := []SubscribableObject{}
+	for _, sobject := range describe.SObjects {
+		if !strings.HasSuffix(sobject.Name, changeEventSuffix) {
+			continue
+		}
+
+		name := strings.TrimSuffix(sobject.Name, changeEventSuffix)
+		if strings.HasSuffix(name, "__") {
+			name += "c"
+		}
+
+		object, ok := byName[name]
+		if !ok {
+			continue
+		}
+
+		topic, err := ParseTopic(name)
+		if err != nil {
+			continue
+		}
+
+		objects = append(objects, SubscribableObject{
+			Name:    object.Name,
+			Label:   object.Label,
+			Topic:   topic.TopicName,
+			Custom:  object.Custom,
+			Enabled: enabled[sobject.Name],
+		})
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Label < objects[j].Label
+	})
+
+	return objects
+}
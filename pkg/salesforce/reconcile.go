@@ -0,0 +1,414 @@
+package salesforce
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"github/michaellimmm/salesforce-app-example/pkg/restclient"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// ChangeTypeSnapshot is the change type of the events carrying the current state of a record,
+	// emitted when the records of a gap event are reconciled or when an object is backfilled.
+	ChangeTypeSnapshot = "SNAPSHOT"
+	// ChangeOriginReconciliation is the change origin of the events emitted by a reconciliation.
+	ChangeOriginReconciliation = "reconciliation"
+	// ChangeOriginBackfill is the change origin of the events emitted by a backfill.
+	ChangeOriginBackfill = "backfill"
+
+	// how many record IDs are queried at a time
+	reconcileBatchSize = 200
+
+	// layout of the date times returned by the REST API
+	restDateTimeLayout = "2006-01-02T15:04:05.000-0700"
+)
+
+// reconcilingHandler dispatches the events of a subscription to the registered handlers and reconciles
+// the records of the gap events instead, whose payloads carry no fields. The handlers get the SNAPSHOT
+// and DELETE events of the reconciliation rather than the gap events.
+type reconcilingHandler struct {
+	s     *salesforce
+	token *accountToken
+}
+
+func (h *reconcilingHandler) HandleEvent(ctx context.Context, event pubsubclient.Event) error {
+	header, ok := event.ChangeEventHeader()
+	if !ok || !header.IsGap() {
+		return h.s.handlers.HandleEvent(ctx, event)
+	}
+
+	h.s.logger.Warn("gap event received, reconciling records",
+		zap.String("org_id", event.OrgID),
+		zap.String("topic", event.TopicName),
+		zap.String("entity", header.EntityName),
+		zap.String("change_type", header.ChangeType),
+		zap.Int("records", len(header.RecordIDs)))
+
+	if header.ChangeType == pubsubclient.ChangeTypeGapOverflow || len(header.RecordIDs) == 0 {
+		return h.s.requestReconciliation(ctx, h.token, event, header)
+	}
+
+	return h.s.reconcile(ctx, h.token, event, header)
+}
+
+// reconcile re-reads the records of the gap event and dispatches a SNAPSHOT event with the current state
+// of every record and a DELETE event for every record that no longer exists.
+func (s *salesforce) reconcile(
+	ctx context.Context,
+	token *accountToken,
+	event pubsubclient.Event,
+	header pubsubclient.ChangeEventHeader) error {
+	snapshot := newSnapshotEmitter(event, header.EntityName, ChangeOriginReconciliation, s.handlers)
+	for i := 0; i < len(header.RecordIDs); i += reconcileBatchSize {
+		ids := header.RecordIDs[i:min(i+reconcileBatchSize, len(header.RecordIDs))]
+
+		quoted := make([]string, 0, len(ids))
+		for _, id := range ids {
+			quoted = append(quoted, "'"+escapeSOQL(id)+"'")
+		}
+
+		if err := s.snapshotRecords(ctx, token, snapshot, "WHERE Id IN ("+strings.Join(quoted, ", ")+")"); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			if snapshot.seen[id] {
+				continue
+			}
+
+			if err := snapshot.emit(ctx, pubsubclient.ChangeTypeDelete, id, nil); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// requestReconciliation stores the request to re-read all records of the object of the gap event, so that
+// the gap event is only checkpointed once the reconciliation can no longer be lost, and runs it in the background,
+// so that the subscription is not held up by the query of a large object.
+func (s *salesforce) requestReconciliation(
+	ctx context.Context,
+	token *accountToken,
+	event pubsubclient.Event,
+	header pubsubclient.ChangeEventHeader) error {
+	reconciliation := models.Reconciliation{
+		OrgID:      event.OrgID,
+		TopicName:  event.TopicName,
+		EntityName: header.EntityName,
+		ReplayID:   event.ReplayID,
+	}
+	if err := reconciliation.Request(ctx); err != nil {
+		s.logger.Error("failed to request reconciliation", zap.Error(err))
+		return err
+	}
+
+	s.startReconciliation(token, reconciliation)
+	return nil
+}
+
+// resumeReconciliations runs the pending reconciliations of the topic, e.g. the ones interrupted by a restart.
+func (s *salesforce) resumeReconciliations(ctx context.Context, token *accountToken, topic string) error {
+	record := models.Reconciliation{OrgID: token.Auth().OrgID, TopicName: topic}
+	reconciliations, err := record.FindAllPendingByOrgIDAndTopic(ctx)
+	if err != nil {
+		s.logger.Error("failed to get pending reconciliations", zap.Error(err))
+		return err
+	}
+
+	for _, reconciliation := range reconciliations {
+		s.startReconciliation(token, reconciliation)
+	}
+
+	return nil
+}
+
+// startReconciliation runs the pending reconciliation of the object in the background. When one is already
+// running for the object, it runs again once it finishes, in case it was requested after the snapshot started.
+func (s *salesforce) startReconciliation(token *accountToken, reconciliation models.Reconciliation) {
+	key := reconciliation.OrgID + reconciliation.TopicName + "/" + reconciliation.EntityName
+	started := s.reconciliations.rerun(s.supervisor.ctx, key, func(ctx context.Context) {
+		s.runReconciliation(ctx, token, reconciliation)
+	})
+	if started {
+		s.logger.Info("reconciliation started",
+			zap.String("org_id", reconciliation.OrgID),
+			zap.String("topic", reconciliation.TopicName),
+			zap.String("entity", reconciliation.EntityName))
+	}
+}
+
+// runReconciliation dispatches a SNAPSHOT event for every record of the object until the reconciliation is
+// no longer pending. A failed snapshot is retried with backoff, a reconciliation requested again while its
+// snapshot is taken is run again. A reconciliation interrupted by a shutdown stays pending.
+func (s *salesforce) runReconciliation(ctx context.Context, token *accountToken, object models.Reconciliation) {
+	logger := s.logger.With(
+		zap.String("org_id", object.OrgID),
+		zap.String("topic", object.TopicName),
+		zap.String("entity", object.EntityName))
+
+	for ctx.Err() == nil {
+		reconciliation := models.Reconciliation{
+			OrgID:      object.OrgID,
+			TopicName:  object.TopicName,
+			EntityName: object.EntityName,
+		}
+		if err := reconciliation.FindPendingByObject(ctx); err != nil {
+			if !errors.Is(err, models.ErrDataNotFound) {
+				logger.Error("failed to get reconciliation", zap.Error(err))
+			}
+			return
+		}
+
+		snapshot := newSnapshotEmitter(pubsubclient.Event{
+			OrgID:     reconciliation.OrgID,
+			TopicName: reconciliation.TopicName,
+			ReplayID:  reconciliation.ReplayID,
+		}, reconciliation.EntityName, ChangeOriginReconciliation, s.handlers)
+		err := s.snapshotRecords(ctx, token, snapshot, "")
+		reconciliation.Records = snapshot.sequenceNumber
+		reconciliation.Attempts++
+
+		if err == nil {
+			completed, err := reconciliation.Complete(context.WithoutCancel(ctx))
+			switch {
+			case err != nil:
+				logger.Error("failed to update reconciliation", zap.Error(err))
+				return
+			case completed:
+				logger.Info("object reconciled", zap.Int64("records", reconciliation.Records))
+				return
+			}
+
+			// requested again while the snapshot was taken
+			continue
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		reconciliation.Error = err.Error()
+		if err := reconciliation.Update(ctx); err != nil {
+			logger.Error("failed to update reconciliation", zap.Error(err))
+		}
+
+		delay := backoff(reconciliation.Attempts)
+		logger.Warn("failed to reconcile object, retrying",
+			zap.Int("attempts", reconciliation.Attempts),
+			zap.Duration("delay", delay),
+			zap.Error(err))
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// snapshotRecords queries all fields of the records of the object matching the condition,
+// e.g. "WHERE Id IN ('001...')", and emits a SNAPSHOT event for every record in the shape of a change event.
+func (s *salesforce) snapshotRecords(
+	ctx context.Context,
+	token *accountToken,
+	snapshot *snapshotEmitter,
+	condition string) error {
+	var describe restclient.DescribeSObjectResponse
+	err := s.withAccessToken(ctx, token, func(auth pubsubclient.Auth) error {
+		var err error
+		describe, err = s.restClient.DescribeSObject(ctx, auth.InstanceUrl, auth.AccessToken, snapshot.entity)
+		return err
+	})
+	if err != nil {
+		s.logger.Error("failed to describe object", zap.String("entity", snapshot.entity), zap.Error(err))
+		return err
+	}
+
+	fields := make([]string, 0, len(describe.Fields))
+	for _, field := range describe.Fields {
+		// base64 fields can only be queried one record at a time
+		if field.Type != "base64" {
+			fields = append(fields, field.Name)
+		}
+	}
+
+	soql := "SELECT " + strings.Join(fields, ", ") + " FROM " + snapshot.entity
+	if condition != "" {
+		soql += " " + condition
+	}
+
+	// the token is refreshed for the page being read, the pages already emitted are not queried again
+	next := ""
+	for {
+		var records []restclient.Record
+		var nextPage string
+		err := s.withAccessToken(ctx, token, func(auth pubsubclient.Auth) error {
+			var err error
+			records, nextPage, err = s.restClient.QueryPage(ctx, auth.InstanceUrl, auth.AccessToken, soql, next)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		next = nextPage
+
+		for _, record := range records {
+			id, _ := record["Id"].(string)
+			if err := snapshot.emit(ctx, ChangeTypeSnapshot, id, changeEventRecord(describe, record)); err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+	}
+}
+
+// changeEventRecord returns the record queried with the REST API in the shape of the body of a change event:
+// the fields of a compound field are nested in it, e.g. {"Name": {"FirstName": ...}} or
+// {"BillingAddress": {"Street": ...}}, date times are milliseconds and dates are days since the epoch.
+func changeEventRecord(describe restclient.DescribeSObjectResponse, record restclient.Record) restclient.Record {
+	compounds := make(map[string]bool)
+	for _, field := range describe.Fields {
+		if field.CompoundFieldName != "" {
+			compounds[field.CompoundFieldName] = true
+		}
+	}
+
+	result := make(restclient.Record, len(record))
+	for _, field := range describe.Fields {
+		value, ok := record[field.Name]
+		if !ok || compounds[field.Name] {
+			continue
+		}
+		value = changeEventValue(field.Type, value)
+
+		if field.CompoundFieldName == "" {
+			result[field.Name] = value
+			continue
+		}
+
+		compound, _ := result[field.CompoundFieldName].(map[string]interface{})
+		if compound == nil {
+			compound = make(map[string]interface{})
+			result[field.CompoundFieldName] = compound
+		}
+		compound[compoundComponentName(field.CompoundFieldName, field.Name)] = value
+	}
+
+	return result
+}
+
+// compoundComponentName returns the name of a field in its compound field, which drops the prefix of
+// the fields of addresses and geolocations, e.g. Street for BillingStreet of BillingAddress or Latitude
+// for Location__Latitude__s of Location__c.
+func compoundComponentName(compound, name string) string {
+	if strings.HasSuffix(name, "__s") {
+		name = strings.TrimSuffix(name, "__s")
+		if i := strings.LastIndex(name, "__"); i >= 0 {
+			return name[i+2:]
+		}
+		return name
+	}
+
+	if prefix, ok := strings.CutSuffix(compound, "Address"); ok && prefix != "" {
+		return strings.TrimPrefix(name, prefix)
+	}
+
+	return name
+}
+
+// changeEventValue converts the date times and dates of the REST API, e.g. 2024-01-02T03:04:05.000+0000
+// and 2024-01-02, to their values in change events. Other values are returned as is.
+func changeEventValue(fieldType string, value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return value
+	}
+
+	switch fieldType {
+	case "datetime":
+		if t, err := time.Parse(restDateTimeLayout, s); err == nil {
+			return t.UnixMilli()
+		}
+	case "date":
+		if t, err := time.Parse(time.DateOnly, s); err == nil {
+			return int32(t.Unix() / int64(24*time.Hour/time.Second))
+		}
+	}
+
+	return value
+}
+
+// snapshotEmitter builds the events of a reconciliation or a backfill, which share a transaction key
+// and carry the replay ID of the event that triggered the reconciliation or where the backfill started.
+type snapshotEmitter struct {
+	source         pubsubclient.Event
+	entity         string
+	origin         string
+	handler        pubsubclient.EventHandler
+	transactionKey string
+	sequenceNumber int64
+	seen           map[string]bool
+}
+
+func newSnapshotEmitter(
+	source pubsubclient.Event,
+	entity, origin string,
+	handler pubsubclient.EventHandler) *snapshotEmitter {
+	return &snapshotEmitter{
+		source:         source,
+		entity:         entity,
+		origin:         origin,
+		handler:        handler,
+		transactionKey: uuid.NewString(),
+		seen:           make(map[string]bool),
+	}
+}
+
+func (e *snapshotEmitter) emit(ctx context.Context, changeType, id string, record restclient.Record) error {
+	e.seen[id] = true
+	e.sequenceNumber++
+
+	body := make(map[string]interface{}, len(record)+1)
+	fields := make([]string, 0, len(record))
+	for name, value := range record {
+		body[name] = value
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+
+	body[pubsubclient.ChangeEventHeaderField] = map[string]interface{}{
+		"entityName":      e.entity,
+		"recordIds":       []interface{}{id},
+		"changeType":      changeType,
+		"changeOrigin":    e.origin,
+		"transactionKey":  e.transactionKey,
+		"sequenceNumber":  e.sequenceNumber,
+		"commitTimestamp": time.Now().UnixMilli(),
+	}
+
+	return e.handler.HandleEvent(ctx, pubsubclient.Event{
+		OrgID:         e.source.OrgID,
+		TopicName:     e.source.TopicName,
+		ReplayID:      e.source.ReplayID,
+		Body:          body,
+		ChangedFields: fields,
+	})
+}
+
+// escapeSOQL escapes a value of a SOQL string literal.
+func escapeSOQL(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+}
@@ -0,0 +1,481 @@
+package salesforce
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+const (
+	// number of stored events read at a time, the progress of a job is saved after every page
+	replayPageSize = 100
+	// events dispatched per second when the rate of a replay is not set
+	defaultReplayRate = 50
+	maxReplayRate     = 1000
+	// number of jobs returned by ListReplayJobs
+	replayJobLimit = 20
+
+	replayLeasePrefix = "replay/"
+)
+
+var (
+	ErrReplayJobNotFound    = errors.New("replay job not found")
+	ErrInvalidReplayRequest = errors.New("invalid replay request")
+	// ErrReplayJobStatus is returned when a finished job is canceled or a job that has not stopped is resumed.
+	ErrReplayJobStatus = errors.New("replay job can't be changed in its current status")
+
+	errReplayJobCanceled = errors.New("replay job canceled")
+
+	// replayableSinks are the handlers that events can be replayed to. The event store would store the
+	// events again and the broadcast would show them as live events.
+	replayableSinks = map[string]bool{
+		WebhookHandlerName: true,
+		MirrorHandlerName:  true,
+	}
+)
+
+type (
+	// ReplayRequest selects the stored events of an account re-dispatched to the sinks,
+	// i.e. the names of the handlers events can be replayed to: webhook or mirror.
+	ReplayRequest struct {
+		// Topics are API names or topic names, all topics when empty
+		Topics []string
+		Sinks  []string
+		// From and To bound the commit timestamps of the events, a zero time is open
+		From time.Time
+		To   time.Time
+		// FromReplayID and ToReplayID are hex encoded and bound the replay IDs of the events of a single topic
+		FromReplayID string
+		ToReplayID   string
+		// Rate is the maximum number of events dispatched per second
+		Rate int
+	}
+
+	ReplayJob struct {
+		ID           string                 `json:"id"`
+		OrgID        string                 `json:"org_id"`
+		TopicNames   []string               `json:"topic_names,omitempty"`
+		Sinks        []string               `json:"sinks"`
+		From         time.Time              `json:"from,omitempty"`
+		To           time.Time              `json:"to,omitempty"`
+		FromReplayID string                 `json:"from_replay_id,omitempty"`
+		ToReplayID   string                 `json:"to_replay_id,omitempty"`
+		Rate         int                    `json:"rate"`
+		Status       models.ReplayJobStatus `json:"status"`
+		Replayed     int64                  `json:"replayed"`
+		Error        string                 `json:"error,omitempty"`
+		CreatedAt    time.Time              `json:"created_at"`
+		UpdatedAt    time.Time              `json:"updated_at"`
+		CompletedAt  *time.Time             `json:"completed_at,omitempty"`
+	}
+)
+
+// StartReplay stores a replay job for the stored events of the account selected by the request
+// and runs it in the background.
+func (s *salesforce) StartReplay(ctx context.Context, clientID string, req ReplayRequest) (ReplayJob, error) {
+	account, err := s.findAccount(ctx, clientID)
+	if err != nil {
+		return ReplayJob{}, err
+	}
+
+	job, err := s.newReplayJob(account.OrgID, req)
+	if err != nil {
+		return ReplayJob{}, err
+	}
+
+	if err := job.Save(ctx); err != nil {
+		s.logger.Error("failed to save replay job", zap.Error(err))
+		return ReplayJob{}, err
+	}
+
+	s.startReplay(job.ID)
+	return replayJobView(job), nil
+}
+
+// GetReplayJob returns the replay job. An empty clientID allows the jobs of all accounts.
+func (s *salesforce) GetReplayJob(ctx context.Context, clientID, id string) (ReplayJob, error) {
+	job, err := s.findReplayJob(ctx, clientID, id)
+	if err != nil {
+		return ReplayJob{}, err
+	}
+
+	return replayJobView(job), nil
+}
+
+// ListReplayJobs returns the latest replay jobs of the account, or of all accounts when clientID is empty,
+// newest first.
+func (s *salesforce) ListReplayJobs(ctx context.Context, clientID string) ([]ReplayJob, error) {
+	record := models.ReplayJob{}
+	if clientID != "" {
+		account, err := s.findAccount(ctx, clientID)
+		if err != nil {
+			return nil, err
+		}
+		record.OrgID = account.OrgID
+	}
+
+	records, err := record.FindLatestByOrgID(ctx, replayJobLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]ReplayJob, 0, len(records))
+	for _, r := range records {
+		jobs = append(jobs, replayJobView(r))
+	}
+
+	return jobs, nil
+}
+
+// CancelReplayJob stops a pending or running replay job, on whichever instance it runs.
+// An empty clientID allows the jobs of all accounts.
+func (s *salesforce) CancelReplayJob(ctx context.Context, clientID, id string) error {
+	job, err := s.findReplayJob(ctx, clientID, id)
+	if err != nil {
+		return err
+	}
+
+	job.Status = models.ReplayJobStatusCanceled
+	ok, err := job.Update(ctx, models.ReplayJobStatusPending, models.ReplayJobStatusRunning)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrReplayJobStatus
+	}
+
+	s.replays.cancel(job.ID.Hex())
+	return nil
+}
+
+// ResumeReplayJob runs a failed or canceled replay job again from the last event it dispatched.
+// An empty clientID allows the jobs of all accounts.
+func (s *salesforce) ResumeReplayJob(ctx context.Context, clientID, id string) error {
+	job, err := s.findReplayJob(ctx, clientID, id)
+	if err != nil {
+		return err
+	}
+
+	job.Status = models.ReplayJobStatusPending
+	job.Error = ""
+	ok, err := job.Update(ctx, models.ReplayJobStatusFailed, models.ReplayJobStatusCanceled)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrReplayJobStatus
+	}
+
+	s.startReplay(job.ID)
+	return nil
+}
+
+// ResumeReplayJobs runs the pending and running replay jobs that are not running on the instance,
+// e.g. the jobs interrupted by a restart. With leases, a job only runs on the instance holding its lease.
+func (s *salesforce) ResumeReplayJobs(ctx context.Context) error {
+	record := models.ReplayJob{}
+	jobs, err := record.FindAllUnfinished(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		s.startReplay(job.ID)
+	}
+
+	return nil
+}
+
+func (s *salesforce) startReplay(id primitive.ObjectID) {
+	started := s.replays.start(s.supervisor.ctx, id.Hex(), func(ctx context.Context) {
+		s.runReplayJob(ctx, id)
+	})
+	if started {
+		s.logger.Info("replay job started", zap.String("id", id.Hex()))
+	}
+}
+
+// runReplayJob dispatches the events of the job from its cursor until all of them are dispatched, a sink
+// fails or the job is canceled. A job interrupted by a shutdown or a lost lease stays running and is
+// continued from its cursor.
+func (s *salesforce) runReplayJob(ctx context.Context, id primitive.ObjectID) {
+	logger := s.logger.With(zap.String("replay_job_id", id.Hex()))
+
+	ctx, release, err := s.holdReplay(ctx, id)
+	if err != nil {
+		return
+	}
+	defer release()
+
+	job := models.ReplayJob{ID: id}
+	if err := job.FindByID(ctx); err != nil {
+		logger.Error("failed to get replay job", zap.Error(err))
+		return
+	}
+
+	job.Status = models.ReplayJobStatusRunning
+	ok, err := job.Update(ctx, models.ReplayJobStatusPending, models.ReplayJobStatusRunning)
+	if err != nil {
+		logger.Error("failed to update replay job", zap.Error(err))
+		return
+	}
+	if !ok {
+		return
+	}
+
+	err = s.replayEvents(ctx, &job)
+	switch {
+	case errors.Is(err, errReplayJobCanceled):
+		logger.Info("replay job canceled", zap.Int64("replayed", job.Replayed))
+		return
+	case err == nil:
+		now := time.Now()
+		job.Status = models.ReplayJobStatusCompleted
+		job.CompletedAt = &now
+		logger.Info("replay job completed", zap.Int64("replayed", job.Replayed))
+	case ctx.Err() != nil:
+		logger.Info("replay job interrupted", zap.Int64("replayed", job.Replayed))
+	default:
+		job.Status = models.ReplayJobStatusFailed
+		job.Error = err.Error()
+		logger.Error("replay job failed", zap.Int64("replayed", job.Replayed), zap.Error(err))
+	}
+
+	if _, err := job.Update(context.WithoutCancel(ctx), models.ReplayJobStatusRunning); err != nil {
+		logger.Error("failed to update replay job", zap.Error(err))
+	}
+}
+
+// holdReplay waits until the instance holds the lease of the job, see leaseKeeper.hold.
+// Without leases, the job runs with ctx.
+func (s *salesforce) holdReplay(ctx context.Context, id primitive.ObjectID) (context.Context, func(), error) {
+	if s.supervisor.leases == nil {
+		return ctx, func() {}, nil
+	}
+
+	return s.supervisor.leases.hold(ctx, replayLeasePrefix+id.Hex(), func() {})
+}
+
+// replayEvents dispatches the stored events of the job after its cursor to its sinks, no faster than its rate,
+// and saves the progress of the job after every page of events.
+func (s *salesforce) replayEvents(ctx context.Context, job *models.ReplayJob) error {
+	sinks := make([]registeredHandler, 0, len(job.Sinks))
+	for _, name := range job.Sinks {
+		sink, ok := s.handlers.lookup(name)
+		if !ok {
+			return fmt.Errorf("sink %q is not registered", name)
+		}
+		sinks = append(sinks, sink)
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(job.Rate))
+	defer ticker.Stop()
+
+	record := models.Event{}
+	for {
+		events, err := record.FindRange(ctx, job.Range(), job.Cursor, replayPageSize)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+
+		for _, stored := range events {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C:
+			}
+
+			event := storedEvent(stored)
+			for _, sink := range sinks {
+				if !sink.matches(event.OrgID, event.TopicName) {
+					continue
+				}
+
+				if err := sink.handler.HandleEvent(ctx, event); err != nil {
+					return fmt.Errorf("sink %s: %w", sink.name, err)
+				}
+			}
+
+			job.Cursor = stored.ID
+			job.Replayed++
+		}
+
+		ok, err := job.Update(ctx, models.ReplayJobStatusRunning)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errReplayJobCanceled
+		}
+	}
+}
+
+// newReplayJob validates the request and returns the pending job of the org.
+func (s *salesforce) newReplayJob(orgID string, req ReplayRequest) (models.ReplayJob, error) {
+	if len(req.Sinks) == 0 {
+		return models.ReplayJob{}, fmt.Errorf("%w: at least one sink is required", ErrInvalidReplayRequest)
+	}
+
+	for _, name := range req.Sinks {
+		if !replayableSinks[name] {
+			return models.ReplayJob{}, fmt.Errorf("%w: sink %q can't be replayed to", ErrInvalidReplayRequest, name)
+		}
+		if _, ok := s.handlers.lookup(name); !ok {
+			return models.ReplayJob{}, fmt.Errorf("%w: sink %q is not registered", ErrInvalidReplayRequest, name)
+		}
+	}
+
+	topicNames := make([]string, 0, len(req.Topics))
+	for _, name := range req.Topics {
+		topic, err := ParseTopic(name)
+		if err != nil {
+			return models.ReplayJob{}, fmt.Errorf("%w: %v", ErrInvalidReplayRequest, err)
+		}
+		topicNames = append(topicNames, topic.TopicName)
+	}
+
+	if !req.From.IsZero() && !req.To.IsZero() && req.To.Before(req.From) {
+		return models.ReplayJob{}, fmt.Errorf("%w: 'to' is before 'from'", ErrInvalidReplayRequest)
+	}
+
+	fromReplayID, err := hex.DecodeString(req.FromReplayID)
+	if err != nil {
+		return models.ReplayJob{}, fmt.Errorf("%w: invalid 'from' replay id", ErrInvalidReplayRequest)
+	}
+
+	toReplayID, err := hex.DecodeString(req.ToReplayID)
+	if err != nil {
+		return models.ReplayJob{}, fmt.Errorf("%w: invalid 'to' replay id", ErrInvalidReplayRequest)
+	}
+
+	if (len(fromReplayID) > 0 || len(toReplayID) > 0) && len(topicNames) != 1 {
+		return models.ReplayJob{}, fmt.Errorf("%w: a replay id range requires a single topic", ErrInvalidReplayRequest)
+	}
+
+	rate := req.Rate
+	if rate == 0 {
+		rate = defaultReplayRate
+	}
+	if rate < 0 || rate > maxReplayRate {
+		return models.ReplayJob{}, fmt.Errorf("%w: rate must be between 1 and %d", ErrInvalidReplayRequest, maxReplayRate)
+	}
+
+	return models.ReplayJob{
+		OrgID:        orgID,
+		TopicNames:   topicNames,
+		Sinks:        req.Sinks,
+		From:         req.From,
+		To:           req.To,
+		FromReplayID: fromReplayID,
+		ToReplayID:   toReplayID,
+		Rate:         rate,
+		Status:       models.ReplayJobStatusPending,
+	}, nil
+}
+
+func (s *salesforce) findReplayJob(ctx context.Context, clientID, id string) (models.ReplayJob, error) {
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return models.ReplayJob{}, ErrReplayJobNotFound
+	}
+
+	job := models.ReplayJob{ID: objectID}
+	if err := job.FindByID(ctx); err != nil {
+		if errors.Is(err, models.ErrDataNotFound) {
+			return models.ReplayJob{}, ErrReplayJobNotFound
+		}
+		return models.ReplayJob{}, err
+	}
+
+	if clientID != "" {
+		account, err := s.findAccount(ctx, clientID)
+		if err != nil {
+			return models.ReplayJob{}, err
+		}
+
+		if account.OrgID != job.OrgID {
+			return models.ReplayJob{}, ErrReplayJobNotFound
+		}
+	}
+
+	return job, nil
+}
+
+func replayJobView(job models.ReplayJob) ReplayJob {
+	return ReplayJob{
+		ID:           job.ID.Hex(),
+		OrgID:        job.OrgID,
+		TopicNames:   job.TopicNames,
+		Sinks:        job.Sinks,
+		From:         job.From,
+		To:           job.To,
+		FromReplayID: hex.EncodeToString(job.FromReplayID),
+		ToReplayID:   hex.EncodeToString(job.ToReplayID),
+		Rate:         job.Rate,
+		Status:       job.Status,
+		Replayed:     job.Replayed,
+		Error:        job.Error,
+		CreatedAt:    job.CreatedAt,
+		UpdatedAt:    job.UpdatedAt,
+		CompletedAt:  job.CompletedAt,
+	}
+}
+
+// storedEvent returns the event as it was received from the stored event, whose payload has been
+// decoded from BSON.
+func storedEvent(stored models.Event) pubsubclient.Event {
+	body, _ := bsonValue(stored.Payload).(map[string]interface{})
+	return pubsubclient.Event{
+		OrgID:         stored.OrgID,
+		TopicName:     stored.TopicName,
+		ReplayID:      stored.ReplayID,
+		SchemaID:      stored.SchemaID,
+		Body:          body,
+		ChangedFields: stored.ChangedFields,
+		NulledFields:  stored.NulledFields,
+		DiffFields:    stored.DiffFields,
+	}
+}
+
+// bsonValue converts the documents, arrays and binaries decoded from BSON
+// to the maps, slices and bytes of a decoded Avro payload.
+func bsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for name, field := range value {
+			result[name] = bsonValue(field)
+		}
+		return result
+	case primitive.M:
+		return bsonValue(map[string]interface{}(value))
+	case primitive.D:
+		result := make(map[string]interface{}, len(value))
+		for _, e := range value {
+			result[e.Key] = bsonValue(e.Value)
+		}
+		return result
+	case primitive.A:
+		return bsonValue([]interface{}(value))
+	case []interface{}:
+		result := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			result = append(result, bsonValue(item))
+		}
+		return result
+	case primitive.Binary:
+		return value.Data
+	default:
+		return value
+	}
+}
@@ -1,9 +1,11 @@
 package salesforce
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"github/michaellimmm/salesforce-app-example/db"
 	"github/michaellimmm/salesforce-app-example/gen/pubsubapi"
 	"github/michaellimmm/salesforce-app-example/models"
 	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
@@ -11,10 +13,10 @@ import (
 	"github/michaellimmm/salesforce-app-example/util/crypto"
 	"net/url"
 	"os"
-	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
-	"golang.org/x/sync/errgroup"
 )
 
 const (
@@ -24,37 +26,146 @@ const (
 	redirectPath = "/linkage/callback"
 )
 
-const (
-	topicOpportunity = "/data/OpportunityChangeEvent"
-	topicEvent       = "/data/EventChangeEvent"
-	topicOrder       = "/data/OrderChangeEvent"
-	topicCase        = "/data/CaseChangeEvent"
-	topicShipment    = "/data/ShipmentChangeEvent"
-)
-
 type (
 	Salesforce interface {
 		GetCallbackUrl() string
 		GetLoginUrl(context.Context, GetLoginUrlRequest) (GetLoginUrlResponse, error)
 		ValidateAuthCode(context.Context, string) error
 		SubscribeAllLinkedToken(ctx context.Context) error
-		SaveStandardObjects(ctx context.Context, clientID string, standardObjects []string) error
+		GetSubscribedObjects(ctx context.Context, clientID string) (models.SubscribedObjects, error)
+		ListSubscribableObjects(ctx context.Context, clientID string) ([]SubscribableObject, error)
+		SaveStandardObjects(
+			ctx context.Context,
+			clientID string,
+			standardObjects models.SubscribedObjects) ([]ChangeDataCaptureResult, error)
+		RegisterTopic(ctx context.Context, clientID string, object models.SubscribedObject) ([]ChangeDataCaptureResult, error)
+		UnregisterTopic(ctx context.Context, clientID string, name string) ([]ChangeDataCaptureResult, error)
+		RegisterHandler(name, orgID, topic string, handler pubsubclient.EventHandler)
+		UnregisterHandler(name string)
+		StartSubscription(ctx context.Context, clientID, topic string) error
+		StopSubscription(ctx context.Context, clientID, topic string) error
+		RestartSubscription(ctx context.Context, clientID, topic string) error
+		ListSubscriptions(clientID string) []SubscriptionState
+		UnlinkAccount(ctx context.Context, clientID string) error
+		Shutdown(ctx context.Context) error
+		ListDeadLetters(ctx context.Context, clientID string) ([]DeadLetter, error)
+		RetryDeadLetter(ctx context.Context, clientID, id string) error
+		DiscardDeadLetter(ctx context.Context, clientID, id string) error
+		GetWebhook(ctx context.Context, clientID string) (Webhook, bool, error)
+		SaveWebhook(ctx context.Context, clientID string, req WebhookRequest) error
+		ListWebhookDeliveries(ctx context.Context, clientID string) ([]WebhookDelivery, error)
+		StreamEvents(ctx context.Context, clientID, topic string) (<-chan pubsubclient.Event, error)
+		StartReplay(ctx context.Context, clientID string, req ReplayRequest) (ReplayJob, error)
+		GetReplayJob(ctx context.Context, clientID, id string) (ReplayJob, error)
+		ListReplayJobs(ctx context.Context, clientID string) ([]ReplayJob, error)
+		CancelReplayJob(ctx context.Context, clientID, id string) error
+		ResumeReplayJob(ctx context.Context, clientID, id string) error
+		ResumeReplayJobs(ctx context.Context) error
+		SchemaHistory(ctx context.Context, orgID, topicName string) ([]SchemaVersion, error)
 	}
 
 	salesforce struct {
-		logger       *zap.Logger
-		serverDomain string
-		restClient   restclient.RestClient
-		pubsubclient *pubsubclient.PubSubClient
+		logger          *zap.Logger
+		serverDomain    string
+		restClient      restclient.RestClient
+		pubsubclient    *pubsubclient.PubSubClient
+		checkpoints     checkpointStore
+		handlers        *handlerRegistry
+		deadLetters     pubsubclient.DeadLetterQueue
+		broadcaster     *broadcaster
+		supervisor      *supervisor
+		replays         *jobRunner
+		reconciliations *jobRunner
+		tokens          map[string]*accountToken
+		tokensMutex     sync.Mutex
+		objects         *objectCache
+		replayPolicies  map[string]pubsubapi.ReplayPreset
+		flowControls    map[string]pubsubclient.FlowControl
+		leases          *db.LeaseManager
+		dedupWindow     time.Duration
+		webhookSecrets  webhookSecrets
 	}
+
+	Option func(s *salesforce)
 )
 
-func NewSalesForce(logger *zap.Logger, restClient restclient.RestClient, pubsubclient *pubsubclient.PubSubClient) Salesforce {
-	return &salesforce{
-		logger:       logger,
-		serverDomain: os.Getenv("HTTP_SERVER_DOMAIN"),
-		restClient:   restClient,
-		pubsubclient: pubsubclient,
+func NewSalesForce(
+	logger *zap.Logger,
+	restClient restclient.RestClient,
+	pubsubClient *pubsubclient.PubSubClient,
+	opts ...Option) Salesforce {
+	s := &salesforce{
+		logger:          logger,
+		serverDomain:    os.Getenv("HTTP_SERVER_DOMAIN"),
+		restClient:      restClient,
+		pubsubclient:    pubsubClient,
+		handlers:        &handlerRegistry{},
+		deadLetters:     &deadLetterStore{logger: logger},
+		broadcaster:     newBroadcaster(logger),
+		supervisor:      newSupervisor(logger),
+		replays:         newJobRunner(),
+		reconciliations: newJobRunner(),
+		tokens:          make(map[string]*accountToken),
+		objects:         &objectCache{entries: make(map[string]objectCacheEntry)},
+		replayPolicies:  make(map[string]pubsubapi.ReplayPreset),
+		flowControls:    make(map[string]pubsubclient.FlowControl),
+		dedupWindow:     defaultDedupWindow,
+	}
+	for _, o := range opts {
+		o(s)
+	}
+
+	s.RegisterHandler(broadcastHandlerName, "", "", s.broadcaster)
+
+	if s.leases != nil {
+		keeper := newLeaseKeeper(logger, s.leases)
+		s.supervisor.leases = keeper
+		go keeper.run(s.supervisor.ctx)
+		s.broadcaster.instanceID = s.leases.InstanceID()
+		go s.broadcaster.relay(s.supervisor.ctx)
+		go s.runSync(s.supervisor.ctx, s.leases.TTL())
+	}
+
+	return s
+}
+
+// WithReplayPolicy sets the replay preset (LATEST or EARLIEST) used for the topic
+// when there is no checkpoint or the checkpoint has expired. The default is LATEST.
+func WithReplayPolicy(topicName string, preset pubsubapi.ReplayPreset) Option {
+	return func(s *salesforce) {
+		s.replayPolicies[topicName] = preset
+	}
+}
+
+// WithFlowControl sets how many events are requested at a time for the topic,
+// see pubsubclient.FlowControl for the adaptive mode.
+func WithFlowControl(topicName string, flow pubsubclient.FlowControl) Option {
+	return func(s *salesforce) {
+		s.flowControls[topicName] = flow
+	}
+}
+
+// WithDedupWindow sets how long a handled event is remembered to drop it when it is received again.
+// The default is 72 hours, the retention of the events by Salesforce.
+// WithWebhookSecretKey sets the 32 bytes key the webhook secrets are encrypted with before they are stored.
+// The secrets are stored as plaintext when no key is set.
+func WithWebhookSecretKey(key []byte) Option {
+	return func(s *salesforce) {
+		s.webhookSecrets = webhookSecrets{key: key}
+	}
+}
+
+func WithDedupWindow(window time.Duration) Option {
+	return func(s *salesforce) {
+		s.dedupWindow = window
+	}
+}
+
+// WithLeases runs every subscription on a single instance among the instances sharing the database,
+// see leaseKeeper. Without leases, every instance runs all subscriptions.
+func WithLeases(leases *db.LeaseManager) Option {
+	return func(s *salesforce) {
+		s.leases = leases
 	}
 }
 
@@ -159,6 +270,7 @@ func (s *salesforce) ValidateAuthCode(ctx context.Context, code string) error {
 			s.logger.Error("failed to save token", zap.Error(err))
 			return err
 		}
+		s.forgetAccountToken(newToken.OrgID)
 
 		return nil
 	}
@@ -166,39 +278,113 @@ func (s *salesforce) ValidateAuthCode(ctx context.Context, code string) error {
 	return fmt.Errorf("auth code is not valid")
 }
 
-func (s *salesforce) SaveStandardObjects(ctx context.Context, clientID string, standardObjects []string) error {
+func (s *salesforce) GetSubscribedObjects(ctx context.Context, clientID string) (models.SubscribedObjects, error) {
+	account := models.Account{ClientID: clientID}
+	if err := account.FindByClientID(ctx); err != nil {
+		s.logger.Error("failed to get account by clientID", zap.Error(err))
+		return nil, err
+	}
+
+	return account.SubscribedObjects, nil
+}
+
+// SaveStandardObjects stores the objects selected for change notifications, enables change data capture
+// for the selected objects and disables it for the deselected ones, schedules the backfill of the existing
+// records of the newly selected objects and, for a linked account, reconciles the running subscriptions
+// with the new selection.
+func (s *salesforce) SaveStandardObjects(
+	ctx context.Context,
+	clientID string,
+	standardObjects models.SubscribedObjects) ([]ChangeDataCaptureResult, error) {
 	account := models.Account{ClientID: clientID}
 	err := account.FindByClientID(ctx)
 	if err != nil {
 		s.logger.Error("failed to get account by clientID", zap.Error(err))
-		return err
+		return nil, err
 	}
 
-	// validate
-	auth := pubsubclient.Auth{
-		AccessToken: account.AccessToken,
-		InstanceUrl: account.InstanceUrl,
-		OrgID:       account.OrgID,
+	for i := 0; i < len(standardObjects); i++ {
+		if _, err := ParseTopic(standardObjects[i].Name); err != nil {
+			return nil, err
+		}
 	}
 
+	token := s.accountToken(account)
+	// validate before change data capture is changed in Salesforce
 	for i := 0; i < len(standardObjects); i++ {
-		object := standardObjects[i]
-		topic := fmt.Sprintf("/data/%sChangeEvent", object)
-		res, err := s.pubsubclient.GetTopic(ctx, auth, topic)
-		if err != nil {
-			s.logger.Error("failed to get topic", zap.Error(err))
-			return err
+		if err := s.checkTopic(ctx, token, objectTopicName(standardObjects[i].Name)); err != nil {
+			return nil, err
 		}
-		s.logger.Info("topic response", zap.Any("topic_response", res))
 	}
 
-	objects := strings.Join(standardObjects, ",")
-	account.SubscribedObjects = objects
-	if err := account.Update(ctx); err != nil {
-		return err
+	previous := account.SubscribedObjects
+	standardObjects, results, err := s.syncChangeDataCapture(ctx, token, previous, standardObjects)
+	if err != nil {
+		return nil, err
+	}
+	s.objects.forget(account.OrgID)
+
+	// the channel members are stored even when some of them failed, so that the created ones can be
+	// deleted later and the deleted ones are not deleted again
+	account.SubscribedObjects = standardObjects
+	if err := account.UpdateSubscribedObjects(ctx); err != nil {
+		s.logger.Error("failed to save subscribed objects", zap.Error(err))
+		return results, err
 	}
 
-	return nil
+	if err := s.scheduleBackfills(ctx, account, previous); err != nil {
+		return results, err
+	}
+
+	if account.Status == string(models.AccountStatusLinked) {
+		return results, s.reconcileSubscriptions(ctx, account, previous)
+	}
+
+	return results, nil
+}
+
+// RegisterTopic adds a standard or custom object, a platform event or a channel to the subscribed
+// objects of the account, replacing the settings of the same topic if it is already subscribed.
+func (s *salesforce) RegisterTopic(ctx context.Context, clientID string, object models.SubscribedObject) ([]ChangeDataCaptureResult, error) {
+	topic, err := ParseTopic(object.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := s.GetSubscribedObjects(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := models.SubscribedObjects{object}
+	for _, o := range objects {
+		if objectTopicName(o.Name) != topic.TopicName {
+			result = append(result, o)
+		}
+	}
+
+	return s.SaveStandardObjects(ctx, clientID, result)
+}
+
+func (s *salesforce) UnregisterTopic(ctx context.Context, clientID string, name string) ([]ChangeDataCaptureResult, error) {
+	topic, err := ParseTopic(name)
+	if err != nil {
+		return nil, err
+	}
+
+	objects, err := s.GetSubscribedObjects(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := models.SubscribedObjects{}
+	for _, o := range objects {
+		if objectTopicName(o.Name) != topic.TopicName {
+			result = append(result, o)
+		}
+	}
+
+	return s.SaveStandardObjects(ctx, clientID, result)
 }
 
 func (s *salesforce) SubscribeAllLinkedToken(ctx context.Context) error {
@@ -209,66 +395,116 @@ func (s *salesforce) SubscribeAllLinkedToken(ctx context.Context) error {
 	}
 
 	for i := 0; i < len(tokens); i++ {
-		token := tokens[i]
-		go func(ctx context.Context, token models.Account) {
-			err := s.subscribe(ctx, token)
-			if err != nil {
-				s.logger.Error("failed to subscribe", zap.Error(err))
-			}
-		}(ctx, token)
+		s.subscribe(tokens[i])
 	}
 
 	return nil
 }
 
-// /data/<Standard_Object_Name>ChangeEvent
-func (s *salesforce) subscribe(ctx context.Context, account models.Account) error {
-	res, err := s.restClient.GetToken(ctx, restclient.TokenRequest{
-		GrantType:    restclient.GrantTypeRefreshToken,
-		RefreshToken: account.RefreshToken,
-		ClientID:     account.ClientID,
-		ClientSecret: account.ClientSecret,
-	})
+func (s *salesforce) subscribe(account models.Account) {
+	for i := 0; i < len(account.SubscribedObjects); i++ {
+		topic, err := ParseTopic(account.SubscribedObjects[i].Name)
+		if err != nil {
+			s.logger.Warn("skip subscribed object", zap.Error(err))
+			continue
+		}
+
+		s.startSubscription(account, topic.TopicName)
+	}
+}
+
+// objectTopicName returns the topic name of a subscribed object, event or channel,
+// or an empty string when the name is not valid.
+func objectTopicName(name string) string {
+	topic, err := ParseTopic(name)
 	if err != nil {
-		return err
+		return ""
 	}
 
-	account.AccessToken = res.AccessToken
-	account.RefreshToken = res.RefreshToken
-	if err := account.Update(ctx); err != nil {
+	return topic.TopicName
+}
+
+// checkTopic verifies that the topic exists, refreshing the access token once if it has expired.
+func (s *salesforce) checkTopic(ctx context.Context, token *accountToken, topic string) error {
+	auth := token.Auth()
+	res, err := s.pubsubclient.GetTopic(ctx, auth, topic)
+	if pubsubclient.IsAuthError(err) {
+		if err := s.refreshToken(ctx, token, auth.AccessToken); err != nil {
+			return err
+		}
+
+		res, err = s.pubsubclient.GetTopic(ctx, token.Auth(), topic)
+	}
+	if err != nil {
+		s.logger.Error("failed to get topic", zap.Error(err))
 		return err
 	}
 
-	auth := pubsubclient.Auth{
-		AccessToken: account.AccessToken,
-		InstanceUrl: account.InstanceUrl,
-		OrgID:       account.OrgID,
+	s.logger.Info("topic response", zap.Any("topic_response", res))
+	return nil
+}
+
+// subscribeTopic resumes the subscription from the stored checkpoint, falling back to
+// the replay policy of the topic when there is no checkpoint or it is no longer valid.
+// When the access token expires, the token is refreshed and the stream is reopened
+// from the last processed replay ID.
+func (s *salesforce) subscribeTopic(
+	ctx context.Context,
+	token *accountToken,
+	topic string,
+	settings topicSettings) error {
+	auth := token.Auth()
+	replayID, err := s.checkpoints.LoadReplayID(ctx, auth.OrgID, topic)
+	if err != nil {
+		return err
 	}
 
-	topics := []string{
-		topicOpportunity,
-		topicEvent,
-		topicOrder,
-		topicCase,
-		topicShipment,
+	req := pubsubclient.SubscribeRequest{
+		TopicName:    topic,
+		ReplayPreset: settings.replayPreset,
+		Checkpointer: s.subscriptionCheckpoints(),
+		Handler:      s.eventHandler(token),
+		FlowControl:  settings.flow,
+		DeadLetters:  s.deadLetters,
 	}
 
-	g, newCtx := errgroup.WithContext(ctx)
-	for i := 0; i < len(topics); i++ {
-		topic := topics[i]
-		res, err := s.pubsubclient.GetTopic(newCtx, auth, topic)
-		if err != nil {
-			s.logger.Error("failed to get topic", zap.Error(err))
-			continue
+	refreshed := false
+	for {
+		if replayID != nil {
+			req.ReplayPreset = pubsubapi.ReplayPreset_CUSTOM
+			req.ReplayID = replayID
 		}
 
-		s.logger.Info("topic response", zap.Any("topic_response", res))
-		g.Go(func() error {
-			_, err = s.pubsubclient.
-				Subscribe(ctx, auth, topic, pubsubapi.ReplayPreset_LATEST, nil)
+		auth = token.Auth()
+		lastReplayID, err := s.pubsubclient.Subscribe(ctx, auth, req)
+		switch {
+		case errors.Is(err, pubsubclient.ErrInvalidReplayID):
+			s.logger.Warn("checkpoint is no longer valid, falling back to replay policy",
+				zap.String("org_id", auth.OrgID),
+				zap.String("topic", topic),
+				zap.Error(err))
+
+			req.ReplayPreset = settings.replayPreset
+			req.ReplayID = nil
+			replayID = nil
+		case pubsubclient.IsAuthError(err):
+			// the stream is only reopened once per token unless events were received in between,
+			// otherwise a revoked grant would keep refreshing forever
+			if refreshed && bytes.Equal(lastReplayID, replayID) {
+				return err
+			}
+
+			s.logger.Info("access token expired, refreshing token",
+				zap.String("org_id", auth.OrgID),
+				zap.String("topic", topic))
+			if err := s.refreshToken(ctx, token, auth.AccessToken); err != nil {
+				return err
+			}
+
+			refreshed = true
+			replayID = lastReplayID
+		default:
 			return err
-		})
+		}
 	}
-
-	return g.Wait()
 }
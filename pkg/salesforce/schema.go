@@ -0,0 +1,135 @@
+package salesforce
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type (
+	// SchemaVersion is a schema seen for a topic, with the fields added and removed
+	// compared to the previous version.
+	SchemaVersion struct {
+		SchemaID      string    `json:"schema_id"`
+		FirstSeenAt   time.Time `json:"first_seen_at"`
+		AddedFields   []string  `json:"added_fields,omitempty"`
+		RemovedFields []string  `json:"removed_fields,omitempty"`
+	}
+
+	schemaRegistry struct {
+		logger *zap.Logger
+	}
+)
+
+// NewSchemaRegistry returns a schema registry stored in the schema collection.
+func NewSchemaRegistry(logger *zap.Logger) pubsubclient.SchemaRegistry {
+	return &schemaRegistry{logger: logger}
+}
+
+func (r *schemaRegistry) LoadSchemas(ctx context.Context) (map[string]string, error) {
+	schema := models.Schema{}
+	schemas, err := schema.FindAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string, len(schemas))
+	for _, s := range schemas {
+		result[s.SchemaID] = s.SchemaJSON
+	}
+
+	return result, nil
+}
+
+// RegisterSchema stores the schema version of the topic and logs the changed fields
+// when it replaces a previous version.
+func (r *schemaRegistry) RegisterSchema(ctx context.Context, orgID, topicName, schemaID, schemaJSON string) error {
+	schema := models.Schema{
+		OrgID:      orgID,
+		TopicName:  topicName,
+		SchemaID:   schemaID,
+		SchemaJSON: schemaJSON,
+	}
+	created, err := schema.SaveIfNotExists(ctx)
+	if err != nil || !created {
+		return err
+	}
+
+	versions, err := schemaVersions(ctx, orgID, topicName)
+	if err != nil {
+		return err
+	}
+
+	if len(versions) < 2 {
+		return nil
+	}
+
+	latest := versions[len(versions)-1]
+	r.logger.Warn("schema of topic changed",
+		zap.String("org_id", orgID),
+		zap.String("topic", topicName),
+		zap.String("schema_id", latest.SchemaID),
+		zap.Strings("added_fields", latest.AddedFields),
+		zap.Strings("removed_fields", latest.RemovedFields))
+
+	return nil
+}
+
+// SchemaHistory returns the schema versions seen for the topic of the org, oldest first.
+func (s *salesforce) SchemaHistory(ctx context.Context, orgID, topicName string) ([]SchemaVersion, error) {
+	return schemaVersions(ctx, orgID, topicName)
+}
+
+func schemaVersions(ctx context.Context, orgID, topicName string) ([]SchemaVersion, error) {
+	schema := models.Schema{
+		OrgID:     orgID,
+		TopicName: topicName,
+	}
+	schemas, err := schema.FindAllByOrgIDAndTopic(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]SchemaVersion, 0, len(schemas))
+	var previous []string
+	for i, s := range schemas {
+		fields, err := pubsubclient.SchemaFieldPaths(s.SchemaJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		version := SchemaVersion{
+			SchemaID:    s.SchemaID,
+			FirstSeenAt: s.FirstSeenAt,
+		}
+		if i > 0 {
+			version.AddedFields = difference(fields, previous)
+			version.RemovedFields = difference(previous, fields)
+		}
+
+		versions = append(versions, version)
+		previous = fields
+	}
+
+	return versions, nil
+}
+
+// difference returns the values of a that are not in b.
+func difference(a, b []string) []string {
+	set := make(map[string]struct{}, len(b))
+	for _, v := range b {
+		set[v] = struct{}{}
+	}
+
+	var result []string
+	for _, v := range a {
+		if _, ok := set[v]; !ok {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,316 @@
+package salesforce
+
+import (
+	"context"
+	"errors"
+	"github/michaellimmm/salesforce-app-example/gen/pubsubapi"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// topicSettings are the settings of the subscription to a topic.
+type topicSettings struct {
+	replayPreset pubsubapi.ReplayPreset
+	flow         pubsubclient.FlowControl
+}
+
+var (
+	ErrAccountNotLinked     = errors.New("account is not linked")
+	ErrSubscriptionNotFound = errors.New("subscription not found")
+	ErrShuttingDown         = errors.New("service is shutting down")
+)
+
+// StartSubscription starts the subscription of the topic. A topic that is not selected yet is added to the
+// subscribed objects of the account, otherwise it would be stopped by the next sync of the subscriptions.
+func (s *salesforce) StartSubscription(ctx context.Context, clientID, topic string) error {
+	account, err := s.findLinkedAccount(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := ParseTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	for _, object := range account.SubscribedObjects {
+		if objectTopicName(object.Name) == parsed.TopicName {
+			s.startSubscription(account, parsed.TopicName)
+			return nil
+		}
+	}
+
+	// standard platform events, e.g. /event/BatchApexErrorEvent, are only recognized by their topic name
+	name := parsed.Name
+	if objectTopicName(name) != parsed.TopicName {
+		name = parsed.TopicName
+	}
+
+	_, err = s.RegisterTopic(ctx, clientID, models.SubscribedObject{Name: name})
+	return err
+}
+
+func (s *salesforce) StopSubscription(ctx context.Context, clientID, topic string) error {
+	account, err := s.findLinkedAccount(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	return s.supervisor.stop(ctx, account.OrgID, topic)
+}
+
+func (s *salesforce) RestartSubscription(ctx context.Context, clientID, topic string) error {
+	account, err := s.findLinkedAccount(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	return s.supervisor.restart(ctx, account.OrgID, topic)
+}
+
+// ListSubscriptions returns the state of the subscriptions of the account,
+// or of all accounts when clientID is empty.
+func (s *salesforce) ListSubscriptions(clientID string) []SubscriptionState {
+	states := []SubscriptionState{}
+	for _, state := range s.supervisor.list() {
+		if clientID == "" || state.ClientID == clientID {
+			states = append(states, state)
+		}
+	}
+
+	return states
+}
+
+// UnlinkAccount stops all subscriptions of the account and marks it as unlinked.
+func (s *salesforce) UnlinkAccount(ctx context.Context, clientID string) error {
+	account, err := s.findLinkedAccount(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	for _, topic := range s.supervisor.topics(account.OrgID) {
+		if err := s.supervisor.stop(ctx, account.OrgID, topic); err != nil {
+			return err
+		}
+	}
+
+	s.forgetAccountToken(account.OrgID)
+
+	account.Status = string(models.AccountStatusUnlinked)
+	return account.Update(ctx)
+}
+
+// Shutdown stops all subscriptions and replay jobs, waiting until the events already received are handled
+// and checkpointed and the progress of the replay jobs is saved or ctx is done, and then leaves the instances
+// sharing the leases. The leases of the subscriptions that didn't stop in time are kept until they expire.
+func (s *salesforce) Shutdown(ctx context.Context) error {
+	if err := s.supervisor.shutdown(ctx); err != nil {
+		s.logger.Error("failed to stop subscriptions", zap.Error(err))
+		return err
+	}
+
+	if err := s.replays.wait(ctx); err != nil {
+		s.logger.Error("failed to stop replay jobs", zap.Error(err))
+		return err
+	}
+
+	if err := s.reconciliations.wait(ctx); err != nil {
+		s.logger.Error("failed to stop reconciliations", zap.Error(err))
+		return err
+	}
+
+	if s.leases == nil {
+		return nil
+	}
+
+	if err := s.leases.Leave(ctx); err != nil {
+		s.logger.Error("failed to release leases", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// startSubscription starts the supervised subscription of the topic, unless it is already running,
+// after the pending backfill of the topic, and resumes the pending reconciliations of the topic.
+func (s *salesforce) startSubscription(account models.Account, topic string) {
+	token := s.accountToken(account)
+	settings := s.topicSettings(account, topic)
+	started := s.supervisor.start(account.ClientID, account.OrgID, topic, func(ctx context.Context) error {
+		if err := s.checkTopic(ctx, token, topic); err != nil {
+			return err
+		}
+
+		earliest, err := s.backfill(ctx, token, topic)
+		if err != nil {
+			return err
+		}
+
+		if err := s.resumeReconciliations(ctx, token, topic); err != nil {
+			return err
+		}
+
+		settings := settings
+		if earliest {
+			settings.replayPreset = pubsubapi.ReplayPreset_EARLIEST
+		}
+
+		return s.subscribeTopic(ctx, token, topic, settings)
+	})
+	if started {
+		s.logger.Info("subscription started",
+			zap.String("org_id", account.OrgID),
+			zap.String("topic", topic))
+	}
+}
+
+// reconcileSubscriptions stops the subscriptions of objects that are no longer selected or whose settings
+// changed, and starts the subscriptions of the selected objects that are not running.
+func (s *salesforce) reconcileSubscriptions(ctx context.Context, account models.Account, previous models.SubscribedObjects) error {
+	for _, object := range previous {
+		if current, ok := account.SubscribedObjects.Find(object.Name); ok && sameSettings(current, object) {
+			continue
+		}
+
+		if err := s.supervisor.stop(ctx, account.OrgID, objectTopicName(object.Name)); err != nil {
+			return err
+		}
+	}
+
+	s.subscribe(account)
+	return nil
+}
+
+func sameSettings(a, b models.SubscribedObject) bool {
+	return a.ReplayPolicy == b.ReplayPolicy &&
+		a.NumRequested == b.NumRequested &&
+		a.MaxInFlight == b.MaxInFlight
+}
+
+// syncSubscriptions starts the subscriptions of the objects selected on other instances and stops the
+// subscriptions of the objects deselected or the accounts unlinked on other instances.
+func (s *salesforce) syncSubscriptions(ctx context.Context) error {
+	account := models.Account{}
+	accounts, err := account.FindAllByStatus(ctx, models.AccountStatusLinked)
+	if err != nil {
+		return err
+	}
+
+	selected := make(map[string]bool)
+	for _, account := range accounts {
+		for _, object := range account.SubscribedObjects {
+			topic := objectTopicName(object.Name)
+			if topic == "" {
+				continue
+			}
+
+			selected[subscriptionKey(account.OrgID, topic)] = true
+			if !s.supervisor.known(account.OrgID, topic) {
+				s.startSubscription(account, topic)
+			}
+		}
+	}
+
+	for _, state := range s.supervisor.list() {
+		if state.Status == SubscriptionStatusStopped || state.Status == SubscriptionStatusFailed ||
+			selected[subscriptionKey(state.OrgID, state.TopicName)] {
+			continue
+		}
+
+		if err := s.supervisor.stop(ctx, state.OrgID, state.TopicName); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runSync calls syncSubscriptions every interval until ctx is done, and resumes the replay jobs
+// started on other instances so that they are taken over when their instance stops.
+func (s *salesforce) runSync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.syncSubscriptions(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("failed to sync subscriptions", zap.Error(err))
+		}
+
+		if err := s.ResumeReplayJobs(ctx); err != nil && ctx.Err() == nil {
+			s.logger.Error("failed to resume replay jobs", zap.Error(err))
+		}
+	}
+}
+
+// topicSettings returns the settings of the subscribed object of the topic, falling back to the
+// defaults of the service for the settings that are not set.
+func (s *salesforce) topicSettings(account models.Account, topic string) topicSettings {
+	settings := topicSettings{
+		replayPreset: s.replayPolicy(topic),
+		flow:         s.flowControls[topic],
+	}
+
+	for _, object := range account.SubscribedObjects {
+		if objectTopicName(object.Name) != topic {
+			continue
+		}
+
+		preset, ok := pubsubapi.ReplayPreset_value[object.ReplayPolicy]
+		if ok && pubsubapi.ReplayPreset(preset) != pubsubapi.ReplayPreset_CUSTOM {
+			settings.replayPreset = pubsubapi.ReplayPreset(preset)
+		}
+		if object.NumRequested > 0 {
+			settings.flow.NumRequested = object.NumRequested
+		}
+		if object.MaxInFlight > 0 {
+			settings.flow.MaxInFlight = object.MaxInFlight
+		}
+	}
+
+	return settings
+}
+
+// accountToken returns the token shared by all subscriptions of the account.
+func (s *salesforce) accountToken(account models.Account) *accountToken {
+	s.tokensMutex.Lock()
+	defer s.tokensMutex.Unlock()
+
+	token, ok := s.tokens[account.OrgID]
+	if !ok {
+		token = newAccountToken(account)
+		s.tokens[account.OrgID] = token
+	}
+
+	return token
+}
+
+// forgetAccountToken drops the cached token of the org, e.g. after the account is linked again.
+func (s *salesforce) forgetAccountToken(orgID string) {
+	s.tokensMutex.Lock()
+	defer s.tokensMutex.Unlock()
+
+	delete(s.tokens, orgID)
+}
+
+func (s *salesforce) findLinkedAccount(ctx context.Context, clientID string) (models.Account, error) {
+	account := models.Account{ClientID: clientID}
+	if err := account.FindByClientID(ctx); err != nil {
+		s.logger.Error("failed to get account by clientID", zap.Error(err))
+		return models.Account{}, err
+	}
+
+	if account.Status != string(models.AccountStatusLinked) {
+		return models.Account{}, ErrAccountNotLinked
+	}
+
+	return account, nil
+}
@@ -0,0 +1,360 @@
+package salesforce
+
+import (
+	"context"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	backoffBase = time.Second
+	backoffMax  = 5 * time.Minute
+	// a subscription that stayed up this long is considered healthy and its attempts are reset
+	backoffResetAfter = time.Minute
+	// number of attempts before a subscription failing with a permanent error is given up
+	maxPermanentAttempts = 3
+)
+
+type SubscriptionStatus string
+
+const (
+	SubscriptionStatusRunning SubscriptionStatus = "RUNNING"
+	SubscriptionStatusBackoff SubscriptionStatus = "BACKOFF"
+	SubscriptionStatusFailed  SubscriptionStatus = "FAILED"
+	SubscriptionStatusStopped SubscriptionStatus = "STOPPED"
+	// the subscription is waiting for its lease, which is held by another instance
+	SubscriptionStatusStandby SubscriptionStatus = "STANDBY"
+)
+
+type (
+	SubscriptionState struct {
+		ClientID    string             `json:"client_id"`
+		OrgID       string             `json:"org_id"`
+		TopicName   string             `json:"topic_name"`
+		Status      SubscriptionStatus `json:"status"`
+		Attempts    int                `json:"attempts"`
+		LastError   string             `json:"last_error,omitempty"`
+		StartedAt   time.Time          `json:"started_at"`
+		NextRetryAt time.Time          `json:"next_retry_at,omitempty"`
+	}
+
+	// supervisor owns the subscription of every (account, topic), each with its own cancellable context,
+	// and restarts it with jittered exponential backoff when it fails. With leases, a subscription only
+	// runs while the instance holds its lease.
+	supervisor struct {
+		logger        *zap.Logger
+		leases        *leaseKeeper
+		ctx           context.Context
+		cancel        context.CancelFunc
+		mutex         sync.RWMutex
+		subscriptions map[string]*supervisedSubscription
+	}
+
+	supervisedSubscription struct {
+		state     SubscriptionState
+		subscribe func(ctx context.Context) error
+		cancel    context.CancelFunc
+		done      chan struct{}
+	}
+)
+
+func newSupervisor(logger *zap.Logger) *supervisor {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &supervisor{
+		logger:        logger,
+		ctx:           ctx,
+		cancel:        cancel,
+		subscriptions: make(map[string]*supervisedSubscription),
+	}
+}
+
+func subscriptionKey(orgID, topic string) string {
+	return orgID + topic
+}
+
+// start runs the subscription in the background unless it is already running or the supervisor is
+// shutting down.
+func (sv *supervisor) start(
+	clientID, orgID, topic string,
+	subscribe func(ctx context.Context) error) bool {
+	key := subscriptionKey(orgID, topic)
+
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+
+	if sv.ctx.Err() != nil {
+		sv.logger.Warn("not starting subscription, shutting down",
+			zap.String("org_id", orgID),
+			zap.String("topic", topic))
+		return false
+	}
+
+	if sub, ok := sv.subscriptions[key]; ok && !sub.isDone() {
+		return false
+	}
+
+	ctx, cancel := context.WithCancel(sv.ctx)
+	sub := &supervisedSubscription{
+		state: SubscriptionState{
+			ClientID:  clientID,
+			OrgID:     orgID,
+			TopicName: topic,
+		},
+		subscribe: subscribe,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	sv.subscriptions[key] = sub
+
+	go func() {
+		defer close(sub.done)
+		sv.run(ctx, sub)
+	}()
+
+	return true
+}
+
+// stop cancels the subscription and waits until it has stopped or ctx is done.
+func (sv *supervisor) stop(ctx context.Context, orgID, topic string) error {
+	sv.mutex.RLock()
+	sub, ok := sv.subscriptions[subscriptionKey(orgID, topic)]
+	sv.mutex.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	sub.cancel()
+
+	select {
+	case <-sub.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown stops all subscriptions and the background work of the supervisor,
+// and waits until the subscriptions have stopped or ctx is done. No subscription is started afterwards.
+func (sv *supervisor) shutdown(ctx context.Context) error {
+	// canceled under the lock, so that no subscription is started once they are collected
+	sv.mutex.Lock()
+	sv.cancel()
+	subs := make([]*supervisedSubscription, 0, len(sv.subscriptions))
+	for _, sub := range sv.subscriptions {
+		subs = append(subs, sub)
+	}
+	sv.mutex.Unlock()
+
+	for _, sub := range subs {
+		select {
+		case <-sub.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// restart stops the subscription and starts it again with the same subscribe function.
+func (sv *supervisor) restart(ctx context.Context, orgID, topic string) error {
+	sv.mutex.RLock()
+	sub, ok := sv.subscriptions[subscriptionKey(orgID, topic)]
+	sv.mutex.RUnlock()
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+
+	if err := sv.stop(ctx, orgID, topic); err != nil {
+		return err
+	}
+
+	if !sv.start(sub.state.ClientID, orgID, topic, sub.subscribe) && sv.ctx.Err() != nil {
+		return ErrShuttingDown
+	}
+
+	return nil
+}
+
+// known reports whether the subscription has been started, whether or not it is still running.
+func (sv *supervisor) known(orgID, topic string) bool {
+	sv.mutex.RLock()
+	defer sv.mutex.RUnlock()
+
+	_, ok := sv.subscriptions[subscriptionKey(orgID, topic)]
+	return ok
+}
+
+// topics returns the topics of the org that are currently supervised.
+func (sv *supervisor) topics(orgID string) []string {
+	sv.mutex.RLock()
+	defer sv.mutex.RUnlock()
+
+	var topics []string
+	for _, sub := range sv.subscriptions {
+		if sub.state.OrgID == orgID && !sub.isDone() {
+			topics = append(topics, sub.state.TopicName)
+		}
+	}
+
+	return topics
+}
+
+// run keeps calling subscribe until the context is canceled or it fails too often with a permanent error.
+func (sv *supervisor) run(ctx context.Context, sub *supervisedSubscription) {
+	logger := sv.logger.With(
+		zap.String("org_id", sub.state.OrgID),
+		zap.String("topic", sub.state.TopicName))
+	attempts := 0
+	permanentAttempts := 0
+	for {
+		leaseCtx, release, err := sv.hold(ctx, sub)
+		if err != nil {
+			sv.update(sub, func(state *SubscriptionState) {
+				state.Status = SubscriptionStatusStopped
+			})
+			return
+		}
+
+		startedAt := time.Now()
+		sv.update(sub, func(state *SubscriptionState) {
+			state.Status = SubscriptionStatusRunning
+			state.StartedAt = startedAt
+			state.NextRetryAt = time.Time{}
+		})
+
+		err = sub.subscribe(leaseCtx)
+		release()
+		if ctx.Err() != nil {
+			sv.update(sub, func(state *SubscriptionState) {
+				state.Status = SubscriptionStatusStopped
+			})
+			return
+		}
+
+		if leaseCtx.Err() != nil {
+			logger.Info("lease lost, waiting for the lease")
+			attempts = 0
+			permanentAttempts = 0
+			continue
+		}
+
+		if time.Since(startedAt) > backoffResetAfter {
+			attempts = 0
+			permanentAttempts = 0
+		}
+		attempts++
+		if pubsubclient.IsPermanentError(err) {
+			permanentAttempts++
+		}
+
+		if permanentAttempts >= maxPermanentAttempts {
+			logger.Error("subscription failed permanently", zap.Int("attempts", attempts), zap.Error(err))
+			sv.update(sub, func(state *SubscriptionState) {
+				state.Status = SubscriptionStatusFailed
+				state.Attempts = attempts
+				state.LastError = errorString(err)
+			})
+			return
+		}
+
+		delay := backoff(attempts)
+		logger.Warn("subscription stopped, retrying",
+			zap.Int("attempts", attempts),
+			zap.Duration("delay", delay),
+			zap.Error(err))
+		sv.update(sub, func(state *SubscriptionState) {
+			state.Status = SubscriptionStatusBackoff
+			state.Attempts = attempts
+			state.LastError = errorString(err)
+			state.NextRetryAt = time.Now().Add(delay)
+		})
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			sv.update(sub, func(state *SubscriptionState) {
+				state.Status = SubscriptionStatusStopped
+			})
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// hold waits until the instance holds the lease of the subscription, see leaseKeeper.hold.
+// Without leases, the subscription runs with ctx.
+func (sv *supervisor) hold(ctx context.Context, sub *supervisedSubscription) (context.Context, func(), error) {
+	if sv.leases == nil {
+		return ctx, func() {}, nil
+	}
+
+	return sv.leases.hold(ctx, subscriptionKey(sub.state.OrgID, sub.state.TopicName), func() {
+		sv.update(sub, func(state *SubscriptionState) {
+			state.Status = SubscriptionStatusStandby
+		})
+	})
+}
+
+func (sv *supervisor) update(sub *supervisedSubscription, fn func(state *SubscriptionState)) {
+	sv.mutex.Lock()
+	defer sv.mutex.Unlock()
+
+	fn(&sub.state)
+}
+
+func (sv *supervisor) list() []SubscriptionState {
+	sv.mutex.RLock()
+	defer sv.mutex.RUnlock()
+
+	states := make([]SubscriptionState, 0, len(sv.subscriptions))
+	for _, sub := range sv.subscriptions {
+		states = append(states, sub.state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].OrgID != states[j].OrgID {
+			return states[i].OrgID < states[j].OrgID
+		}
+		return states[i].TopicName < states[j].TopicName
+	})
+
+	return states
+}
+
+func (sub *supervisedSubscription) isDone() bool {
+	select {
+	case <-sub.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff returns the delay before the given attempt, doubling from backoffBase up to backoffMax
+// with half of it randomized so that subscriptions failing together don't retry together.
+func backoff(attempts int) time.Duration {
+	delay := backoffMax
+	if attempts < 32 {
+		if d := backoffBase << (attempts - 1); d > 0 && d < backoffMax {
+			delay = d
+		}
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
@@ -0,0 +1,57 @@
+package salesforce
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		delay    time.Duration
+	}{
+		{attempts: 1, delay: time.Second},
+		{attempts: 2, delay: 2 * time.Second},
+		{attempts: 3, delay: 4 * time.Second},
+		{attempts: 9, delay: 256 * time.Second},
+		{attempts: 10, delay: backoffMax},
+		{attempts: 31, delay: backoffMax},
+		// the shift overflows
+		{attempts: 32, delay: backoffMax},
+		{attempts: 100, delay: backoffMax},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.attempts), func(t *testing.T) {
+			// half of the delay is randomized
+			for i := 0; i < 100; i++ {
+				got := backoff(tt.attempts)
+				if got < tt.delay/2 || got > tt.delay {
+					t.Fatalf("backoff(%d) = %s, want between %s and %s", tt.attempts, got, tt.delay/2, tt.delay)
+				}
+			}
+		})
+	}
+}
+
+func TestSupervisorRefusesStartAfterShutdown(t *testing.T) {
+	sv := newSupervisor(zap.NewNop())
+	if err := sv.shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	started := sv.start("client", "org", "/data/AccountChangeEvent", func(ctx context.Context) error {
+		t.Error("subscription started after shutdown")
+		return nil
+	})
+	if started {
+		t.Fatalf("start() = true after shutdown, want false")
+	}
+	if sv.known("org", "/data/AccountChangeEvent") {
+		t.Fatalf("subscription is known after shutdown")
+	}
+}
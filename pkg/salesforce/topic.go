@@ -0,0 +1,116 @@
+package salesforce
+
+import (
+	"fmt"
+	"github/michaellimmm/salesforce-app-example/pkg/restclient"
+	"regexp"
+	"strings"
+)
+
+const (
+	dataTopicPrefix  = "/data/"
+	eventTopicPrefix = "/event/"
+
+	customObjectSuffix  = "__c"
+	platformEventSuffix = "__e"
+	customChannelSuffix = "__chn"
+	changeEventSuffix   = "ChangeEvent"
+)
+
+type TopicKind string
+
+const (
+	TopicKindStandardObject TopicKind = "STANDARD_OBJECT"
+	TopicKindCustomObject   TopicKind = "CUSTOM_OBJECT"
+	TopicKindPlatformEvent  TopicKind = "PLATFORM_EVENT"
+	TopicKindChannel        TopicKind = "CHANNEL"
+)
+
+var apiNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+
+// Topic is a Pub/Sub API topic, built from the API name of what is subscribed to.
+type Topic struct {
+	// Name is the API name, e.g. Account, Foo__c, Bar__e or MyChannel__chn
+	Name      string
+	Kind      TopicKind
+	TopicName string
+}
+
+// ParseTopic returns the topic of an API name or of a topic name:
+//   - Account -> /data/AccountChangeEvent
+//   - Foo__c -> /data/Foo__ChangeEvent
+//   - Bar__e -> /event/Bar__e
+//   - MyChannel__chn -> /data/MyChannel__chn
+//
+// Topic names, e.g. /data/Foo__ChangeEvent, are accepted as well.
+func ParseTopic(name string) (Topic, error) {
+	name = strings.TrimSpace(name)
+
+	switch {
+	case strings.HasPrefix(name, eventTopicPrefix):
+		// standard platform events, e.g. /event/BatchApexErrorEvent, have no suffix
+		event := strings.TrimPrefix(name, eventTopicPrefix)
+		if !apiNamePattern.MatchString(event) {
+			return Topic{}, fmt.Errorf("invalid event topic %q", name)
+		}
+
+		return Topic{
+			Name:      event,
+			Kind:      TopicKindPlatformEvent,
+			TopicName: name,
+		}, nil
+	case strings.HasPrefix(name, dataTopicPrefix):
+		return parseDataTopic(strings.TrimPrefix(name, dataTopicPrefix))
+	}
+
+	if !apiNamePattern.MatchString(name) {
+		return Topic{}, fmt.Errorf("invalid object, event or channel name %q", name)
+	}
+
+	switch {
+	case strings.HasSuffix(name, customObjectSuffix):
+		return Topic{
+			Name:      name,
+			Kind:      TopicKindCustomObject,
+			TopicName: dataTopicPrefix + strings.TrimSuffix(name, customObjectSuffix) + "__" + changeEventSuffix,
+		}, nil
+	case strings.HasSuffix(name, platformEventSuffix):
+		return Topic{
+			Name:      name,
+			Kind:      TopicKindPlatformEvent,
+			TopicName: eventTopicPrefix + name,
+		}, nil
+	case strings.HasSuffix(name, customChannelSuffix), name == restclient.ChangeEventsChannel:
+		return Topic{
+			Name:      name,
+			Kind:      TopicKindChannel,
+			TopicName: dataTopicPrefix + name,
+		}, nil
+	case strings.Contains(name, "__"):
+		return Topic{}, fmt.Errorf("unsupported object, event or channel name %q", name)
+	}
+
+	return Topic{
+		Name:      name,
+		Kind:      TopicKindStandardObject,
+		TopicName: dataTopicPrefix + name + changeEventSuffix,
+	}, nil
+}
+
+func parseDataTopic(name string) (Topic, error) {
+	switch {
+	case strings.HasSuffix(name, customChannelSuffix), name == restclient.ChangeEventsChannel:
+		return ParseTopic(name)
+	case strings.HasSuffix(name, "__"+changeEventSuffix):
+		return ParseTopic(strings.TrimSuffix(name, "__"+changeEventSuffix) + customObjectSuffix)
+	case strings.HasSuffix(name, changeEventSuffix):
+		return ParseTopic(strings.TrimSuffix(name, changeEventSuffix))
+	}
+
+	return Topic{}, fmt.Errorf("invalid data topic %q", dataTopicPrefix+name)
+}
+
+// IsChangeEvent reports whether the topic carries change data capture events.
+func (t Topic) IsChangeEvent() bool {
+	return t.Kind == TopicKindStandardObject || t.Kind == TopicKindCustomObject || t.Kind == TopicKindChannel
+}
@@ -0,0 +1,101 @@
+package salesforce
+
+import "testing"
+
+func TestParseTopic(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Topic
+		wantErr bool
+	}{
+		{
+			name: "Account",
+			want: Topic{Name: "Account", Kind: TopicKindStandardObject, TopicName: "/data/AccountChangeEvent"},
+		},
+		{
+			name: " Account ",
+			want: Topic{Name: "Account", Kind: TopicKindStandardObject, TopicName: "/data/AccountChangeEvent"},
+		},
+		{
+			name: "Foo__c",
+			want: Topic{Name: "Foo__c", Kind: TopicKindCustomObject, TopicName: "/data/Foo__ChangeEvent"},
+		},
+		{
+			name: "ns__Foo__c",
+			want: Topic{Name: "ns__Foo__c", Kind: TopicKindCustomObject, TopicName: "/data/ns__Foo__ChangeEvent"},
+		},
+		{
+			name: "Bar__e",
+			want: Topic{Name: "Bar__e", Kind: TopicKindPlatformEvent, TopicName: "/event/Bar__e"},
+		},
+		{
+			name: "MyChannel__chn",
+			want: Topic{Name: "MyChannel__chn", Kind: TopicKindChannel, TopicName: "/data/MyChannel__chn"},
+		},
+		{
+			name: "ChangeEvents",
+			want: Topic{Name: "ChangeEvents", Kind: TopicKindChannel, TopicName: "/data/ChangeEvents"},
+		},
+		{
+			name: "/data/AccountChangeEvent",
+			want: Topic{Name: "Account", Kind: TopicKindStandardObject, TopicName: "/data/AccountChangeEvent"},
+		},
+		{
+			name: "/data/Foo__ChangeEvent",
+			want: Topic{Name: "Foo__c", Kind: TopicKindCustomObject, TopicName: "/data/Foo__ChangeEvent"},
+		},
+		{
+			name: "/data/ns__Foo__ChangeEvent",
+			want: Topic{Name: "ns__Foo__c", Kind: TopicKindCustomObject, TopicName: "/data/ns__Foo__ChangeEvent"},
+		},
+		{
+			name: "/data/MyChannel__chn",
+			want: Topic{Name: "MyChannel__chn", Kind: TopicKindChannel, TopicName: "/data/MyChannel__chn"},
+		},
+		{
+			name: "/event/Bar__e",
+			want: Topic{Name: "Bar__e", Kind: TopicKindPlatformEvent, TopicName: "/event/Bar__e"},
+		},
+		{
+			name: "/event/BatchApexErrorEvent",
+			want: Topic{Name: "BatchApexErrorEvent", Kind: TopicKindPlatformEvent, TopicName: "/event/BatchApexErrorEvent"},
+		},
+		{name: "", wantErr: true},
+		{name: "1Account", wantErr: true},
+		{name: "Account Contact", wantErr: true},
+		{name: "Foo__x", wantErr: true},
+		{name: "/data/Account", wantErr: true},
+		{name: "/data/Foo-ChangeEvent", wantErr: true},
+		{name: "/event/", wantErr: true},
+		{name: "/event/Bar/e", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseTopic(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTopic(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("ParseTopic(%q) = %+v, want %+v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTopicRoundTrip(t *testing.T) {
+	for _, name := range []string{"Account", "Foo__c", "ns__Foo__c", "Bar__e", "MyChannel__chn", "ChangeEvents"} {
+		topic, err := ParseTopic(name)
+		if err != nil {
+			t.Fatalf("ParseTopic(%q) error = %v", name, err)
+		}
+
+		parsed, err := ParseTopic(topic.TopicName)
+		if err != nil {
+			t.Fatalf("ParseTopic(%q) error = %v", topic.TopicName, err)
+		}
+		if parsed != topic {
+			t.Fatalf("ParseTopic(%q) = %+v, want %+v", topic.TopicName, parsed, topic)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+package salesforce
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github/michaellimmm/salesforce-app-example/models"
+	"github/michaellimmm/salesforce-app-example/pkg/pubsubclient"
+	"github/michaellimmm/salesforce-app-example/util/crypto"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	WebhookHandlerName = "webhook"
+
+	// WebhookSignatureHeader carries the hex encoded HMAC-SHA256 of the body with the secret of the webhook,
+	// prefixed with "sha256=".
+	WebhookSignatureHeader = "X-Signature-256"
+
+	webhookMaxAttempts = 10
+	webhookTimeout     = 10 * time.Second
+	// number of events posted at the same time
+	webhookWorkers = 4
+	// how often the outbox is checked for due events when it is empty
+	webhookPollInterval = time.Second
+	// how long an event is claimed by a worker, longer than a delivery attempt
+	webhookClaimTimeout = 3 * webhookTimeout
+	// how long delivered and failed events are kept in the outbox
+	webhookOutboxRetention = models.WebhookRetention
+	// number of delivery attempts shown on the webhook page
+	webhookDeliveryLimit = 20
+)
+
+var (
+	ErrInvalidWebhookURL = errors.New("webhook url must be an absolute http or https url")
+	// ErrWebhookSecretKey is returned when an encrypted webhook secret is read without the key it was encrypted with.
+	ErrWebhookSecretKey = errors.New("webhook secret key is not configured")
+)
+
+// prefix of the webhook secrets encrypted with the webhook secret key, the secrets stored without it are plaintext
+const encryptedSecretPrefix = "enc:"
+
+type (
+	// Webhook is the endpoint the events of an account are posted to.
+	Webhook struct {
+		URL       string
+		HasSecret bool
+		Topics    []string
+	}
+
+	WebhookRequest struct {
+		URL string
+		// Secret replaces the secret of the webhook unless it is empty
+		Secret string
+		// Topics are API names, e.g. Account or Bar__e, all subscribed objects when empty
+		Topics []string
+	}
+
+	WebhookDelivery struct {
+		TopicName  string
+		ReplayID   string
+		Attempt    int
+		StatusCode int
+		Error      string
+		Duration   time.Duration
+		CreatedAt  time.Time
+	}
+
+	// webhookPayload is the JSON body posted to a webhook for every event.
+	webhookPayload struct {
+		OrgID         string                 `json:"org_id"`
+		TopicName     string                 `json:"topic_name"`
+		ReplayID      string                 `json:"replay_id"`
+		SchemaID      string                 `json:"schema_id,omitempty"`
+		ChangedFields []string               `json:"changed_fields,omitempty"`
+		NulledFields  []string               `json:"nulled_fields,omitempty"`
+		DiffFields    []string               `json:"diff_fields,omitempty"`
+		Payload       map[string]interface{} `json:"payload"`
+	}
+
+	// WebhookSink is an event handler that queues the events in the webhook outbox of their org, so that the
+	// subscriptions are not held up by a slow or failing endpoint. Its workers post the queued events to the
+	// webhooks, retrying with backoff until they respond with a 2xx status.
+	WebhookSink struct {
+		logger  *zap.Logger
+		client  *resty.Client
+		secrets webhookSecrets
+		cancel  context.CancelFunc
+		wg      sync.WaitGroup
+	}
+
+	// webhookSecrets encrypts the webhook secrets stored in the database with AES-256-GCM when a key is
+	// configured. Without a key, the secrets are stored as plaintext.
+	webhookSecrets struct {
+		key []byte
+	}
+)
+
+// NewWebhookSink returns the webhook sink, secretKey is the key the webhook secrets are encrypted with,
+// see WithWebhookSecretKey.
+func NewWebhookSink(logger *zap.Logger, client *resty.Client, secretKey []byte) *WebhookSink {
+	client.SetTimeout(webhookTimeout)
+	return &WebhookSink{logger: logger, client: client, secrets: webhookSecrets{key: secretKey}}
+}
+
+// seal returns the secret as it is stored.
+func (s webhookSecrets) seal(secret string) (string, error) {
+	if len(s.key) == 0 || secret == "" {
+		return secret, nil
+	}
+
+	encrypted, err := crypto.Encrypt(s.key, secret)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedSecretPrefix + encrypted, nil
+}
+
+// open returns the secret of its stored value.
+func (s webhookSecrets) open(stored string) (string, error) {
+	encrypted, ok := strings.CutPrefix(stored, encryptedSecretPrefix)
+	if !ok {
+		return stored, nil
+	}
+	if len(s.key) == 0 {
+		return "", ErrWebhookSecretKey
+	}
+
+	return crypto.Decrypt(s.key, encrypted)
+}
+
+func (w *WebhookSink) HandleEvent(ctx context.Context, event pubsubclient.Event) error {
+	webhook := models.Webhook{OrgID: event.OrgID}
+	if err := webhook.FindByOrgID(ctx); err != nil {
+		if errors.Is(err, models.ErrDataNotFound) {
+			return nil
+		}
+
+		w.logger.Error("failed to get webhook", zap.Error(err))
+		return err
+	}
+
+	if !webhookMatches(webhook, event.TopicName) {
+		return nil
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		OrgID:         event.OrgID,
+		TopicName:     event.TopicName,
+		ReplayID:      hex.EncodeToString(event.ReplayID),
+		SchemaID:      event.SchemaID,
+		ChangedFields: event.ChangedFields,
+		NulledFields:  event.NulledFields,
+		DiffFields:    event.DiffFields,
+		Payload:       event.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	outbox := models.WebhookOutbox{
+		Key:       dedupKey(event),
+		OrgID:     event.OrgID,
+		TopicName: event.TopicName,
+		ReplayID:  event.ReplayID,
+		Body:      body,
+	}
+	if err := outbox.Enqueue(ctx); err != nil {
+		w.logger.Error("failed to queue webhook event", zap.Error(err))
+		return err
+	}
+
+	return nil
+}
+
+// Start starts the workers posting the queued events until Shutdown is called.
+func (w *WebhookSink) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	w.cancel = cancel
+
+	for i := 0; i < webhookWorkers; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			w.work(ctx)
+		}()
+	}
+}
+
+// Shutdown stops the workers and waits until the events being posted are delivered or ctx is done.
+// The events claimed by a worker that didn't stop in time are posted again once their claim expires.
+func (w *WebhookSink) Shutdown(ctx context.Context) error {
+	if w.cancel == nil {
+		return nil
+	}
+	w.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work posts the due events of the outbox one at a time until ctx is done.
+func (w *WebhookSink) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		outbox := models.WebhookOutbox{}
+		err := outbox.ClaimNext(ctx, time.Now().Add(webhookClaimTimeout))
+		if err == nil {
+			// an event being posted is finished on shutdown
+			w.deliver(context.WithoutCancel(ctx), outbox)
+			continue
+		}
+
+		if !errors.Is(err, models.ErrDataNotFound) && ctx.Err() == nil {
+			w.logger.Error("failed to claim webhook event", zap.Error(err))
+		}
+
+		timer := time.NewTimer(webhookPollInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// deliver posts the queued event to the webhook of its org and schedules the next attempt when it fails.
+func (w *WebhookSink) deliver(ctx context.Context, outbox models.WebhookOutbox) {
+	logger := w.logger.With(
+		zap.String("org_id", outbox.OrgID),
+		zap.String("topic", outbox.TopicName))
+
+	outbox.Attempts++
+	webhook := models.Webhook{OrgID: outbox.OrgID}
+	err := webhook.FindByOrgID(ctx)
+	switch {
+	case errors.Is(err, models.ErrDataNotFound):
+		err = errors.New("webhook has been removed")
+		outbox.Attempts = webhookMaxAttempts
+	case err == nil && !webhookMatches(webhook, outbox.TopicName):
+		err = errors.New("topic is no longer delivered to the webhook")
+		outbox.Attempts = webhookMaxAttempts
+	case err == nil:
+		var secret string
+		secret, err = w.secrets.open(webhook.Secret)
+		if err != nil {
+			break
+		}
+
+		signature := "sha256=" + crypto.HMACSHA256Hex(secret, outbox.Body)
+		err = w.post(ctx, webhook, outbox, signature)
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(webhookOutboxRetention)
+	outbox.Error = errorString(err)
+	switch {
+	case err == nil:
+		outbox.Status = models.WebhookOutboxStatusDelivered
+		outbox.ExpiresAt = &expiresAt
+	case outbox.Attempts >= webhookMaxAttempts:
+		logger.Error("failed to deliver event to webhook", zap.Int("attempts", outbox.Attempts), zap.Error(err))
+		outbox.Status = models.WebhookOutboxStatusFailed
+		outbox.ExpiresAt = &expiresAt
+	default:
+		outbox.NextAttemptAt = now.Add(backoff(outbox.Attempts))
+	}
+
+	if err := outbox.Update(ctx); err != nil {
+		logger.Error("failed to update webhook event", zap.Error(err))
+	}
+}
+
+// post posts the body to the webhook and records the attempt.
+func (w *WebhookSink) post(
+	ctx context.Context,
+	webhook models.Webhook,
+	outbox models.WebhookOutbox,
+	signature string) error {
+	startedAt := time.Now()
+	resp, err := w.client.R().SetContext(ctx).
+		SetHeader("Content-Type", "application/json").
+		SetHeader(WebhookSignatureHeader, signature).
+		SetBody(outbox.Body).
+		Post(webhook.URL)
+	if err == nil && resp.IsError() {
+		err = fmt.Errorf("webhook responded with %s", resp.Status())
+	}
+
+	delivery := models.WebhookDelivery{
+		WebhookID: webhook.ID,
+		OrgID:     outbox.OrgID,
+		TopicName: outbox.TopicName,
+		ReplayID:  outbox.ReplayID,
+		Attempt:   outbox.Attempts,
+		Error:     errorString(err),
+		Duration:  time.Since(startedAt),
+	}
+	if resp != nil {
+		delivery.StatusCode = resp.StatusCode()
+	}
+	if err := delivery.Save(ctx); err != nil {
+		w.logger.Error("failed to save webhook delivery", zap.Error(err))
+	}
+
+	return err
+}
+
+// webhookMatches reports whether the events of the topic are posted to the webhook.
+func webhookMatches(webhook models.Webhook, topicName string) bool {
+	if len(webhook.Topics) == 0 {
+		return true
+	}
+
+	for _, topic := range webhook.Topics {
+		if objectTopicName(topic) == topicName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetWebhook returns the webhook of the account, or false when none is configured.
+func (s *salesforce) GetWebhook(ctx context.Context, clientID string) (Webhook, bool, error) {
+	account, err := s.findAccount(ctx, clientID)
+	if err != nil {
+		return Webhook{}, false, err
+	}
+
+	webhook := models.Webhook{OrgID: account.OrgID}
+	if err := webhook.FindByOrgID(ctx); err != nil {
+		if errors.Is(err, models.ErrDataNotFound) {
+			return Webhook{}, false, nil
+		}
+
+		return Webhook{}, false, err
+	}
+
+	return Webhook{
+		URL:       webhook.URL,
+		HasSecret: webhook.Secret != "",
+		Topics:    webhook.Topics,
+	}, true, nil
+}
+
+// SaveWebhook configures the webhook of the account, an empty URL removes it.
+func (s *salesforce) SaveWebhook(ctx context.Context, clientID string, req WebhookRequest) error {
+	account, err := s.findAccount(ctx, clientID)
+	if err != nil {
+		return err
+	}
+
+	webhook := models.Webhook{OrgID: account.OrgID}
+	if req.URL == "" {
+		return webhook.Delete(ctx)
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+
+	for _, topic := range req.Topics {
+		if _, err := ParseTopic(topic); err != nil {
+			return err
+		}
+	}
+
+	secret, err := s.webhookSecrets.seal(req.Secret)
+	if err != nil {
+		return err
+	}
+	if secret == "" {
+		previous := models.Webhook{OrgID: account.OrgID}
+		if err := previous.FindByOrgID(ctx); err != nil && !errors.Is(err, models.ErrDataNotFound) {
+			return err
+		}
+		secret = previous.Secret
+	}
+
+	webhook.URL = req.URL
+	webhook.Secret = secret
+	webhook.Topics = req.Topics
+	return webhook.Upsert(ctx)
+}
+
+// ListWebhookDeliveries returns the latest delivery attempts of the webhook of the account, newest first.
+func (s *salesforce) ListWebhookDeliveries(ctx context.Context, clientID string) ([]WebhookDelivery, error) {
+	account, err := s.findAccount(ctx, clientID)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery := models.WebhookDelivery{OrgID: account.OrgID}
+	records, err := delivery.FindLatestByOrgID(ctx, webhookDeliveryLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]WebhookDelivery, 0, len(records))
+	for _, r := range records {
+		deliveries = append(deliveries, WebhookDelivery{
+			TopicName:  r.TopicName,
+			ReplayID:   hex.EncodeToString(r.ReplayID),
+			Attempt:    r.Attempt,
+			StatusCode: r.StatusCode,
+			Error:      r.Error,
+			Duration:   r.Duration,
+			CreatedAt:  r.CreatedAt,
+		})
+	}
+
+	return deliveries, nil
+}
@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestHMACSHA256Hex(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  string
+		message string
+		want    string
+	}{
+		{
+			// RFC 4231, test case 2
+			name:    "rfc 4231",
+			secret:  "Jefe",
+			message: "what do ya want for nothing?",
+			want:    "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		},
+		{
+			name:    "pangram",
+			secret:  "key",
+			message: "The quick brown fox jumps over the lazy dog",
+			want:    "f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		},
+		{
+			name:    "empty secret and message",
+			secret:  "",
+			message: "",
+			want:    "b613679a0814d9ec772f95d778c35fc5ff1697c493715653c6c712144292c5ad",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HMACSHA256Hex(tt.secret, []byte(tt.message)); got != tt.want {
+				t.Fatalf("HMACSHA256Hex(%q, %q) = %s, want %s", tt.secret, tt.message, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+
+	encrypted, err := Encrypt(key, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted == "secret" {
+		t.Fatalf("Encrypt returned the plaintext")
+	}
+
+	decrypted, err := Decrypt(key, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "secret" {
+		t.Fatalf("Decrypt() = %q, want %q", decrypted, "secret")
+	}
+
+	if _, err := Decrypt(bytes.Repeat([]byte{2}, 32), encrypted); err == nil {
+		t.Fatalf("Decrypt with another key error = nil, want error")
+	}
+
+	if _, err := Encrypt(key[:16], "secret"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("Encrypt with a 16 bytes key error = %v, want %v", err, ErrInvalidKey)
+	}
+}